@@ -0,0 +1,367 @@
+package purescript_aff
+
+import (
+	"container/list"
+	"sync"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+func init() {
+	exports := Foreign("Effect.AVar")
+
+	// FFIUtil is { left, right, nothing, just, killed, filled, empty }
+	// AVarCallback a is Either Error a -> Effect Unit
+
+	// empty :: forall a. Effect (AVar a)
+	exports["empty"] = func() Any {
+		return NewEmptyAVar()
+	}
+
+	// _newVar :: forall a. a -> Effect (AVar a)
+	exports["_newVar"] = func(value Any) Any {
+		return func() Any {
+			return NewAVar(value)
+		}
+	}
+
+	// _killVar :: forall a. Fn3 FFIUtil Error (AVar a) (Effect Unit)
+	exports["_killVar"] = func(util_ Any, err Any, avar_ Any) Any {
+		return func() Any {
+			avar := avar_.(*AVar)
+			avar.Kill(err)
+			return nil
+		}
+	}
+
+	// _putVar :: forall a. Fn4 FFIUtil a (AVar a) (AVarCallback Unit) (Effect (Effect Unit))
+	exports["_putVar"] = func(util_ Any, value Any, avar_ Any, cb Any) Any {
+		return func() Any {
+			util := util_.(Dict)
+			avar := avar_.(*AVar)
+			cancel := avar.Put(value, func(err Any) {
+				Run(Apply(cb, either(util, err, nil)))
+			})
+			return func() Any {
+				cancel()
+				return nil
+			}
+		}
+	}
+
+	// _tryPutVar :: forall a. Fn3 FFIUtil a (AVar a) (Effect Boolean)
+	exports["_tryPutVar"] = func(util_ Any, value Any, avar_ Any) Any {
+		return func() Any {
+			avar := avar_.(*AVar)
+			return avar.TryPut(value)
+		}
+	}
+
+	// _takeVar :: forall a. Fn3 FFIUtil (AVar a) (AVarCallback a) (Effect (Effect Unit))
+	exports["_takeVar"] = func(util_ Any, avar_ Any, cb Any) Any {
+		return func() Any {
+			util := util_.(Dict)
+			avar := avar_.(*AVar)
+			cancel := avar.Take(func(err Any, value Any) {
+				Run(Apply(cb, either(util, err, value)))
+			})
+			return func() Any {
+				cancel()
+				return nil
+			}
+		}
+	}
+
+	// _tryTakeVar :: forall a. Fn2 FFIUtil (AVar a) (Effect (Maybe a))
+	exports["_tryTakeVar"] = func(util_ Any, avar_ Any) Any {
+		return func() Any {
+			util := util_.(Dict)
+			avar := avar_.(*AVar)
+			value, ok := avar.TryTake()
+			return maybe(util, value, ok)
+		}
+	}
+
+	// _readVar :: forall a. Fn3 FFIUtil (AVar a) (AVarCallback a) (Effect (Effect Unit))
+	exports["_readVar"] = func(util_ Any, avar_ Any, cb Any) Any {
+		return func() Any {
+			util := util_.(Dict)
+			avar := avar_.(*AVar)
+			cancel := avar.Read(func(err Any, value Any) {
+				Run(Apply(cb, either(util, err, value)))
+			})
+			return func() Any {
+				cancel()
+				return nil
+			}
+		}
+	}
+
+	// _tryReadVar :: forall a. Fn2 FFIUtil (AVar a) (Effect (Maybe a))
+	exports["_tryReadVar"] = func(util_ Any, avar_ Any) Any {
+		return func() Any {
+			util := util_.(Dict)
+			avar := avar_.(*AVar)
+			value, ok := avar.TryRead()
+			return maybe(util, value, ok)
+		}
+	}
+
+	// _status :: forall a. Fn2 FFIUtil (AVar a) (Effect (AVarStatus a))
+	exports["_status"] = func(util_ Any, avar_ Any) Any {
+		return func() Any {
+			util := util_.(Dict)
+			avar := avar_.(*AVar)
+			return avarStatus(util, avar)
+		}
+	}
+}
+
+// either builds an Either Error a with the FFIUtil constructors
+func either(util Dict, err Any, value Any) Any {
+	if err != nil {
+		return Apply(util["left"], err)
+	}
+	return Apply(util["right"], value)
+}
+
+// maybe builds a Maybe with the FFIUtil constructors
+func maybe(util Dict, value Any, ok bool) Any {
+	if ok {
+		return Apply(util["just"], value)
+	}
+	return util["nothing"]
+}
+
+func avarStatus(util Dict, avar *AVar) Any {
+	err, value, filled := avar.Status()
+	switch {
+	case err != nil:
+		return Apply(util["killed"], err)
+	case filled:
+		return Apply(util["filled"], value)
+	}
+	return util["empty"]
+}
+
+// AVar is an asynchronous variable: a box that is either empty or holds a
+// value, with FIFO queues of fibers waiting to put, take or read it. It may be
+// used from any goroutine; callbacks run on the goroutine that made the
+// change, outside the lock.
+type AVar struct {
+	mu       sync.Mutex
+	value    Any
+	filled   bool
+	err      Any // set when killed
+	draining bool
+
+	puts  *list.List // of *avarPut
+	takes *list.List // of func(err, value Any)
+	reads *list.List // of func(err, value Any)
+}
+
+type avarPut struct {
+	value Any
+	cb    func(err Any)
+}
+
+// NewEmptyAVar creates an empty AVar
+func NewEmptyAVar() *AVar {
+	return &AVar{puts: list.New(), takes: list.New(), reads: list.New()}
+}
+
+// NewAVar creates an AVar holding value
+func NewAVar(value Any) *AVar {
+	v := NewEmptyAVar()
+	v.value = value
+	v.filled = true
+	return v
+}
+
+// enqueue adds a waiter and drains the AVar. The returned function removes
+// the waiter if it hasn't been called yet.
+func (v *AVar) enqueue(queue *list.List, waiter Any) func() {
+	v.mu.Lock()
+	e := queue.PushBack(waiter)
+	v.mu.Unlock()
+	v.drain()
+	return func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		// Remove is a no-op once drain has taken the element
+		queue.Remove(e)
+	}
+}
+
+// Put waits until the AVar is empty and fills it with value
+func (v *AVar) Put(value Any, cb func(err Any)) func() {
+	return v.enqueue(v.puts, &avarPut{value: value, cb: cb})
+}
+
+// Take waits until the AVar is filled and empties it
+func (v *AVar) Take(cb func(err Any, value Any)) func() {
+	return v.enqueue(v.takes, cb)
+}
+
+// Read waits until the AVar is filled, leaving the value in place
+func (v *AVar) Read(cb func(err Any, value Any)) func() {
+	return v.enqueue(v.reads, cb)
+}
+
+// TryPut fills the AVar if it is empty and not killed
+func (v *AVar) TryPut(value Any) bool {
+	v.mu.Lock()
+	if v.filled || v.err != nil {
+		v.mu.Unlock()
+		return false
+	}
+	v.value = value
+	v.filled = true
+	v.mu.Unlock()
+	v.drain()
+	return true
+}
+
+// putBack returns a taken value to the head of the AVar, or hands it to the
+// next taker. A value put since waits behind it. It is dropped if the AVar
+// has been killed.
+func (v *AVar) putBack(value Any) {
+	v.mu.Lock()
+	switch {
+	case v.err != nil:
+	case v.filled:
+		v.puts.PushFront(&avarPut{value: v.value, cb: func(Any) {}})
+		v.value = value
+	default:
+		v.value = value
+		v.filled = true
+	}
+	v.mu.Unlock()
+	v.drain()
+}
+
+// TryTake empties the AVar if it is filled
+func (v *AVar) TryTake() (Any, bool) {
+	v.mu.Lock()
+	if !v.filled {
+		v.mu.Unlock()
+		return nil, false
+	}
+	value := v.value
+	v.value = nil
+	v.filled = false
+	v.mu.Unlock()
+	v.drain()
+	return value, true
+}
+
+// TryRead returns the value of the AVar if it is filled
+func (v *AVar) TryRead() (Any, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.value, v.filled
+}
+
+// Kill empties the AVar and fails every waiter, now and in the future,
+// with err
+func (v *AVar) Kill(err Any) {
+	v.mu.Lock()
+	if v.err != nil {
+		v.mu.Unlock()
+		return
+	}
+	v.err = err
+	v.value = nil
+	v.filled = false
+	v.mu.Unlock()
+	v.drain()
+}
+
+// Status returns the error the AVar was killed with, or its value
+func (v *AVar) Status() (err Any, value Any, filled bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err, v.value, v.filled
+}
+
+func pop(queue *list.List) Any {
+	e := queue.Front()
+	if e == nil {
+		return nil
+	}
+	return queue.Remove(e)
+}
+
+// drain matches waiters with the state of the AVar, in the order they
+// arrived. Only one goroutine drains at a time; changes made while callbacks
+// run, by them or by other goroutines, are picked up before it stops.
+func (v *AVar) drain() {
+	v.mu.Lock()
+	if v.draining {
+		v.mu.Unlock()
+		return
+	}
+	v.draining = true
+
+	for {
+		var callbacks []func()
+
+		if v.err != nil {
+			err := v.err
+			for p := pop(v.puts); p != nil; p = pop(v.puts) {
+				cb := p.(*avarPut).cb
+				callbacks = append(callbacks, func() { cb(err) })
+			}
+			for _, queue := range []*list.List{v.reads, v.takes} {
+				for w := pop(queue); w != nil; w = pop(queue) {
+					cb := w.(func(Any, Any))
+					callbacks = append(callbacks, func() { cb(err, nil) })
+				}
+			}
+		} else {
+			var put *avarPut
+			if !v.filled {
+				if p := pop(v.puts); p != nil {
+					put = p.(*avarPut)
+					v.value = put.value
+					v.filled = true
+				}
+			}
+			if v.filled {
+				value := v.value
+				// Readers queued so far see the value before the next taker
+				for r := pop(v.reads); r != nil; r = pop(v.reads) {
+					cb := r.(func(Any, Any))
+					callbacks = append(callbacks, func() { cb(nil, value) })
+				}
+				if t := pop(v.takes); t != nil {
+					v.value = nil
+					v.filled = false
+					cb := t.(func(Any, Any))
+					callbacks = append(callbacks, func() { cb(nil, value) })
+				}
+			}
+			if put != nil {
+				cb := put.cb
+				callbacks = append(callbacks, func() { cb(nil) })
+			}
+		}
+
+		v.mu.Unlock()
+		for _, cb := range callbacks {
+			cb()
+		}
+		v.mu.Lock()
+
+		idle := v.puts.Len() == 0 && v.takes.Len() == 0 && v.reads.Len() == 0
+		if v.err == nil {
+			idle = (!v.filled && v.puts.Len() == 0) ||
+				(v.filled && v.takes.Len() == 0 && v.reads.Len() == 0)
+		}
+		if idle {
+			v.draining = false
+			v.mu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package purescript_aff
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+// makeAVarUtil creates the FFIUtil passed to Effect.AVar
+func makeAVarUtil() Dict {
+	util := makeUtil()
+	util["nothing"] = Dict{}
+	util["just"] = func(v Any) Any { return Dict{"value0": v} }
+	util["empty"] = "empty"
+	util["filled"] = func(v Any) Any { return Dict{"filled": v} }
+	util["killed"] = func(e Any) Any { return Dict{"killed": e} }
+	return util
+}
+
+func TestAVarFIFO(t *testing.T) {
+	exports := Foreign("Effect.AVar")
+	takeVar := exports["_takeVar"].(func(Any, Any, Any) Any)
+	tryPutVar := exports["_tryPutVar"].(func(Any, Any, Any) Any)
+	util := makeAVarUtil()
+
+	avar := Run(exports["empty"])
+	var order []Any
+	for i := 0; i < 3; i++ {
+		taker := i
+		Run(takeVar(util, avar, func(result Any) Any {
+			return func() Any {
+				order = append(order, []Any{taker, result.(Dict)["Right"]})
+				return nil
+			}
+		}))
+	}
+	for _, value := range []string{"a", "b", "c"} {
+		if Run(tryPutVar(util, value, avar)) != true {
+			t.Fatalf("Expected tryPut of %s to succeed", value)
+		}
+	}
+
+	expected := [][]Any{{0, "a"}, {1, "b"}, {2, "c"}}
+	for i, e := range expected {
+		pair := order[i].([]Any)
+		if pair[0] != e[0] || pair[1] != e[1] {
+			t.Errorf("Expected taker %v to get %v, got %v", e[0], e[1], order)
+		}
+	}
+	status := Run(exports["_status"].(func(Any, Any) Any)(util, avar))
+	if status != "empty" {
+		t.Errorf("Expected an empty AVar, got %v", status)
+	}
+}
+
+func TestAVarKilledTakerRemoved(t *testing.T) {
+	exports := Foreign("Effect.Aff.AVar")
+	take := exports["take"].(func(Any) Any)
+	avar := NewEmptyAVar()
+
+	// A fiber waiting to take is killed before anything is put
+	fiber := Fiber(makeUtil(), nil, take(avar)).(Dict)
+	Run(fiber["run"])
+	Run(fiber["kill"].(func(Any, Any) Any)(errors.New("stop"), func(Any) Any {
+		return func() Any { return nil }
+	}))
+
+	if !avar.TryPut("kept") {
+		t.Fatal("Expected tryPut to succeed")
+	}
+	if value, ok := avar.TryRead(); !ok || value != "kept" {
+		t.Errorf("Expected the value to stay for the next taker, got %v", value)
+	}
+	if result := launch(take(avar)); result["Right"] != "kept" {
+		t.Errorf("Expected Right kept, got %v", result)
+	}
+}
+
+func TestAVarKilledAfterDelivery(t *testing.T) {
+	exports := Foreign("Effect.Aff.AVar")
+	take := exports["take"].(func(Any) Any)
+	avar := NewAVar("first")
+	kill := func(fiber Dict) {
+		Run(fiber["kill"].(func(Any, Any) Any)(errors.New("stop"), func(Any) func() Any {
+			return func() Any { return nil }
+		}))
+	}
+
+	// The value is handed over at once, but the fiber is killed before its
+	// resume runs on the event loop
+	fiber := Fiber(makeUtil(), nil, take(avar)).(Dict)
+	Run(fiber["run"])
+	kill(fiber)
+	RunEventLoop()
+	if value, ok := avar.TryRead(); !ok || value != "first" {
+		t.Errorf("Expected the value to be put back, got %v", value)
+	}
+
+	// A put that filled the AVar meanwhile goes after the returned value
+	avar = NewAVar("first")
+	fiber = Fiber(makeUtil(), nil, take(avar)).(Dict)
+	Run(fiber["run"])
+	avar.TryPut("second")
+	kill(fiber)
+	RunEventLoop()
+	first, _ := avar.TryTake()
+	second, _ := avar.TryTake()
+	if first != "first" || second != "second" {
+		t.Errorf("Expected first then second, got %v and %v", first, second)
+	}
+
+	// A waiting taker gets the returned value
+	avar = NewAVar("first")
+	fiber = Fiber(makeUtil(), nil, take(avar)).(Dict)
+	Run(fiber["run"])
+	waiting := Fiber(makeUtil(), nil, take(avar)).(Dict)
+	var result Any
+	waiting["onComplete"].(func(OnComplete) func() Any)(OnComplete{handler: func(res Any) func() Any {
+		return func() Any {
+			result = res
+			return nil
+		}
+	}})()
+	Run(waiting["run"])
+	kill(fiber)
+	RunEventLoop()
+	if result.(Dict)["Right"] != "first" {
+		t.Errorf("Expected the waiting taker to get first, got %v", result)
+	}
+}
+
+func TestAVarKill(t *testing.T) {
+	exports := Foreign("Effect.Aff.AVar")
+	put := exports["put"].(func(Any, Any) Any)
+	avar := NewAVar(1)
+	failure := errors.New("killed")
+
+	// A put waits for the full AVar and fails when it is killed
+	result := launch(MakeBind(MakeSync(func() Any {
+		go avar.Kill(failure)
+		return nil
+	}), func(Any) Any {
+		return put(2, avar)
+	}))
+	if result["Left"] != failure {
+		t.Errorf("Expected the put to fail with the kill error, got %v", result)
+	}
+	status := Run(Foreign("Effect.AVar")["_status"].(func(Any, Any) Any)(makeAVarUtil(), avar))
+	if status.(Dict)["killed"] != failure {
+		t.Errorf("Expected a killed status, got %v", status)
+	}
+}
+
+// Puts and takes from many goroutines and fibers hand over every value once
+// (checked with go test -race)
+func TestAVarConcurrent(t *testing.T) {
+	take := Foreign("Effect.Aff.AVar")["take"].(func(Any) Any)
+	avar := NewEmptyAVar()
+
+	const count = 100
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done := make(chan struct{})
+			avar.Put(i, func(err Any) { close(done) })
+			<-done
+		}(i)
+	}
+
+	seen := map[Any]bool{}
+	var takeAll func(n int) Any
+	takeAll = func(n int) Any {
+		if n == 0 {
+			return MakePure(nil)
+		}
+		return MakeBind(take(avar), func(value Any) Any {
+			seen[value] = true
+			return takeAll(n - 1)
+		})
+	}
+	launch(takeAll(count))
+	wg.Wait()
+
+	if len(seen) != count {
+		t.Errorf("Expected %d distinct values, got %d", count, len(seen))
+	}
+}
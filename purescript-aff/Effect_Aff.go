@@ -1,34 +1,206 @@
 package purescript_aff
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
 	. "github.com/purescript-native/go-runtime"
 )
 
 // Re-export types for clarity
 type Effect = EffFn // Effect is func() Any
 
-// Internal queue for goroutines to schedule effects on main thread
-var effectQueue = make(chan EffFn, 100)
+// eventLoop runs the effects that goroutines queue for the main thread. The
+// goroutine that launches the first fiber runs the loop, and keeps running it
+// while fibers, timers or async effects are still alive, like Node's process.
+type eventLoop struct {
+	mu      sync.Mutex
+	wake    *sync.Cond
+	queue   []EffFn
+	fibers  int // fibers that have started and not completed
+	pending int // armed timers and async effects that have yet to resume
+	running bool
+}
+
+var loop = newEventLoop()
+
+func newEventLoop() *eventLoop {
+	l := &eventLoop{}
+	l.wake = sync.NewCond(&l.mu)
+	return l
+}
+
+// push adds an effect to the run queue; the queue is unbounded so
+// producers never block
+func (l *eventLoop) push(eff EffFn) {
+	l.mu.Lock()
+	l.queue = append(l.queue, eff)
+	l.mu.Unlock()
+	l.wake.Broadcast()
+}
+
+// pop takes the next effect, returning false if there is none
+func (l *eventLoop) pop() (EffFn, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) == 0 {
+		return nil, false
+	}
+	eff := l.queue[0]
+	l.queue[0] = nil
+	l.queue = l.queue[1:]
+	return eff, true
+}
+
+// add changes the fiber and pending counts, waking the loop so it can
+// notice when it has become idle
+func (l *eventLoop) add(fibers, pending int) {
+	l.mu.Lock()
+	l.fibers += fibers
+	l.pending += pending
+	l.mu.Unlock()
+	l.wake.Broadcast()
+}
+
+// hold keeps the loop alive until the returned function is called; calling
+// it more than once has no further effect
+func (l *eventLoop) hold() func() {
+	l.add(0, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.add(0, -1) })
+	}
+}
+
+// run processes effects on the calling goroutine until no work is left.
+// It returns immediately if the loop is already running.
+func (l *eventLoop) run() {
+	l.runUntil(nil)
+}
+
+// runUntil is run, also returning once stop reports true after an effect.
+// The loop stops running under the same lock that found it idle, so work
+// pushed by a caller that saw it running is never stranded.
+func (l *eventLoop) runUntil(stop func() bool) {
+	l.mu.Lock()
+	if l.running {
+		l.mu.Unlock()
+		return
+	}
+	l.running = true
+	l.mu.Unlock()
+	stopped := false
+	defer func() {
+		if !stopped {
+			l.mu.Lock()
+			l.running = false
+			l.mu.Unlock()
+		}
+	}()
+
+	for {
+		l.mu.Lock()
+		for len(l.queue) == 0 && (l.fibers > 0 || l.pending > 0) {
+			l.wake.Wait()
+		}
+		if len(l.queue) == 0 {
+			l.running = false
+			stopped = true
+			l.mu.Unlock()
+			l.wake.Broadcast()
+			return
+		}
+		eff := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+
+		Run(eff)
+		if stop != nil && stop() {
+			l.mu.Lock()
+			l.running = false
+			stopped = true
+			l.mu.Unlock()
+			// Another goroutine may be waiting to take over
+			l.wake.Broadcast()
+			return
+		}
+	}
+}
+
+// drive runs the loop on the calling goroutine until done reports true.
+// While another goroutine is running the loop it waits, taking over if that
+// goroutine stops first. done must not block; call notify after it changes.
+func (l *eventLoop) drive(done func() bool) {
+	for !done() {
+		l.runUntil(done)
+		l.mu.Lock()
+		for l.running && !done() {
+			l.wake.Wait()
+		}
+		l.mu.Unlock()
+	}
+}
 
-// DrainEffectQueue processes any pending effects (call from main thread/loop)
+// notify wakes goroutines waiting in drive
+func (l *eventLoop) notify() {
+	l.mu.Lock()
+	l.mu.Unlock()
+	l.wake.Broadcast()
+}
+
+// RunEventLoop runs queued effects on the calling goroutine until no
+// fibers, timers or async effects remain. launchAff calls it automatically.
+func RunEventLoop() {
+	loop.run()
+}
+
+// DrainEffectQueue processes the effects queued so far without waiting
+// for more
 func DrainEffectQueue() {
 	for {
-		select {
-		case eff := <-effectQueue:
-			Run(eff)
-		default:
+		eff, ok := loop.pop()
+		if !ok {
 			return
 		}
+		Run(eff)
 	}
 }
 
 // QueueEffect queues an effect to be run on the main thread (call from goroutines)
 func QueueEffect(eff EffFn) {
-	effectQueue <- eff
+	loop.push(eff)
+}
+
+// ResumeAsync delivers the result of an async effect to its callback on the
+// main thread. FFI code must use this instead of applying callbacks from its
+// own goroutines, so that fibers only ever resume on one thread.
+func ResumeAsync(cb AsyncCallback, result Any) {
+	QueueEffect(func() Any {
+		return Run(callbackEffect(cb, result))
+	})
+}
+
+// callbackEffect applies an async callback to a result, returning the effect to run.
+// Callbacks are either created by a Fiber or are curried PureScript functions.
+func callbackEffect(cb AsyncCallback, result Any) EffFn {
+	switch f := cb.(type) {
+	case func(Any) func() Any:
+		return f(result)
+	default:
+		return Apply(cb, result).(EffFn)
+	}
 }
 
 // MakeAsync creates an Async Aff from an asyncFn
@@ -37,6 +209,261 @@ func MakeAsync(asyncFn AsyncFn) Async {
 	return Async{asyncFn: asyncFn}
 }
 
+// MakeSync creates a Sync Aff from an effect
+// Like MakeAsync, this is for FFI code in other packages (e.g. to build cancelers)
+func MakeSync(eff EffFn) Sync {
+	return Sync{eff: eff}
+}
+
+// MakePure creates a Pure Aff
+func MakePure(value Any) Pure {
+	return Pure{value: value}
+}
+
+// MakeThrow creates an Aff that fails with err
+func MakeThrow(err Any) Throw {
+	return Throw{err: err}
+}
+
+// MakeBind creates a Bind Aff, running k with the result of aff
+func MakeBind(aff Any, k func(Any) Any) Bind {
+	return Bind{affOfB: aff, bToAff: k}
+}
+
+// MakeCatch creates a Catch Aff, recovering from errors in aff with k
+func MakeCatch(aff Any, k func(Any) Any) Catch {
+	return Catch{aff: aff, errorToAff: k}
+}
+
+// MakeGoAsync creates an async Aff whose callbacks take plain values rather
+// than Either, so Go code doesn't need the util record. The callbacks may be
+// called from any goroutine; the fiber is resumed on the main thread.
+func MakeGoAsync(fn func(onError func(Any), onSuccess func(Any)) Canceler) GoAsync {
+	return GoAsync{fn: fn}
+}
+
+// Delay creates an Aff that resumes with unit after d, like delay
+func Delay(d time.Duration) GoAsync {
+	return GoAsync{fn: func(onError func(Any), onSuccess func(Any)) Canceler {
+		stop := startTimer(d, func() { onSuccess(nil) })
+		return func(error Any) Any {
+			return Sync{eff: func() Any {
+				stop()
+				return nil
+			}}
+		}
+	}}
+}
+
+// armedTimers counts the timers started by delay that have yet to fire or
+// be stopped
+var armedTimers int64
+
+// startTimer calls f after d on its own goroutine. The armed timer keeps
+// the event loop alive until it fires or stop is called; stop reports
+// whether it stopped the timer before it fired.
+func startTimer(d time.Duration, f func()) (stop func() bool) {
+	release := loop.hold()
+	atomic.AddInt64(&armedTimers, 1)
+	var once sync.Once
+	disarm := func() {
+		once.Do(func() {
+			atomic.AddInt64(&armedTimers, -1)
+			release()
+		})
+	}
+	timer := time.AfterFunc(d, func() {
+		disarm()
+		f()
+	})
+	return func() bool {
+		if timer.Stop() {
+			disarm()
+			return true
+		}
+		return false
+	}
+}
+
+// ContextCanceler creates a canceler that cancels a context, for makeAff
+// style FFI code whose Go side stops when its context is done
+func ContextCanceler(cancel context.CancelFunc) Canceler {
+	return func(error Any) Any {
+		return Sync{eff: func() Any {
+			cancel()
+			return nil
+		}}
+	}
+}
+
+// AffFromContextFunc creates an Aff that calls fn on its own goroutine.
+// Killing the fiber cancels the context passed to fn; fn should return
+// soon after, and its result is then ignored.
+func AffFromContextFunc(fn func(ctx context.Context) (Any, error)) GoAsync {
+	return GoAsync{fn: func(onError func(Any), onSuccess func(Any)) Canceler {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			defer cancel()
+			value, err := fn(ctx)
+			if err != nil {
+				onError(err)
+				return
+			}
+			onSuccess(value)
+		}()
+		return ContextCanceler(cancel)
+	}}
+}
+
+// goResult is the Either of fibers run from Go with RunAffWithContext
+type goResult struct {
+	err   Any
+	value Any
+	isErr bool
+}
+
+var goUtil = Dict{
+	"isLeft":    func(e Any) Any { return e.(goResult).isErr },
+	"fromLeft":  func(e Any) Any { return e.(goResult).err },
+	"fromRight": func(e Any) Any { return e.(goResult).value },
+	"left":      func(err Any) Any { return goResult{err: err, isErr: true} },
+	"right":     func(value Any) Any { return goResult{value: value} },
+}
+
+// RunAffWithContext runs aff in a new fiber and waits for its result. It may
+// be called from any goroutine: the fiber runs on the event loop, and if no
+// other goroutine is running the loop the caller runs it until the fiber
+// completes. If ctx is done first the fiber is killed with ctx.Err().
+func RunAffWithContext(ctx context.Context, aff Any) (Any, error) {
+	var finished int32
+	var result goResult
+	done := func() bool { return atomic.LoadInt32(&finished) == 1 }
+
+	// The hold keeps a running loop from stopping before the fiber starts
+	release := loop.hold()
+	var fiber Dict
+	QueueEffect(func() Any {
+		fiber = Fiber(goUtil, nil, aff).(Dict)
+		fiber["onComplete"].(func(OnComplete) func() Any)(OnComplete{handler: func(res Any) func() Any {
+			return func() Any {
+				result = res.(goResult)
+				atomic.StoreInt32(&finished, 1)
+				release()
+				loop.notify()
+				return nil
+			}
+		}})()
+		Run(fiber["run"])
+		return nil
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			QueueEffect(func() Any {
+				if !done() {
+					Run(fiber["kill"].(func(Any, Any) Any)(ctx.Err(), func(Any) func() Any {
+						return func() Any { return nil }
+					}))
+				}
+				return nil
+			})
+		case <-stop:
+		}
+	}()
+
+	loop.drive(done)
+	if result.isErr {
+		return nil, affError(result.err)
+	}
+	return result.value, nil
+}
+
+// affError converts an Aff failure to a Go error
+func affError(err Any) error {
+	return exceptions.ToError(err)
+}
+
+// launched makes running a fiber also run the event loop, so that the
+// outermost launchAff returns once all the work it started is done
+func launched(fiber Any) Any {
+	fiberDict := fiber.(Dict)
+	run := fiberDict["run"].(func() Any)
+	fiberDict["run"] = func() Any {
+		run()
+		if deadline, ok := testMode.deadlineSet(); ok {
+			testMode.runLoop(deadline)
+		} else {
+			loop.run()
+		}
+		return nil
+	}
+	return fiberDict
+}
+
+// settled is the result of a race branch that failed. Branches are raced
+// with ParAlt, which waits for a success, so failures are turned into
+// values until the race is decided.
+type settled struct {
+	err Any
+}
+
+func settle(aff Any) Any {
+	return MakeCatch(aff, func(err Any) Any {
+		return MakePure(settled{err: err})
+	})
+}
+
+func unsettle(value Any) Any {
+	if s, ok := value.(settled); ok {
+		return MakeThrow(s.err)
+	}
+	return MakePure(value)
+}
+
+// alt runs branches in parallel and resumes with the first to succeed. The
+// other branches are killed, running their cancelers.
+func alt(branches []Any) Any {
+	if len(branches) == 0 {
+		return MakeThrow(errors.New("no Affs to race"))
+	}
+	par := branches[0]
+	for _, branch := range branches[1:] {
+		par = ParAlt{option1: par, option2: branch, result: EMPTY}
+	}
+	return Sequential{parAff: par}
+}
+
+// Timeout runs aff, resuming with Just its result, or with Nothing once d
+// has passed, in which case aff is killed
+func Timeout(d time.Duration, aff Any) Any {
+	result := MakeBind(aff, func(value Any) Any {
+		return MakePure(Dict{"value0": value}) // Just value
+	})
+	expired := MakeBind(Delay(d), func(Any) Any {
+		return MakePure(Dict{}) // Nothing
+	})
+	return MakeBind(alt([]Any{settle(result), expired}), unsettle)
+}
+
+// Race runs affs in parallel and finishes like the first of them to
+// finish, successfully or not. The others are killed.
+func Race(affs []Any) Any {
+	branches := make([]Any, len(affs))
+	for i, aff := range affs {
+		branches[i] = settle(aff)
+	}
+	return MakeBind(alt(branches), unsettle)
+}
+
+// FirstSuccess runs affs in parallel and resumes with the first success,
+// killing the others. It fails only if all of them fail.
+func FirstSuccess(affs []Any) Any {
+	return alt(affs)
+}
+
 // Pure a
 type Pure struct {
 	value Any
@@ -44,7 +471,7 @@ type Pure struct {
 
 // Throw Error
 type Throw struct {
-	err error
+	err Any
 }
 
 // Catch (Aff a) (Error -> Aff a)
@@ -67,6 +494,11 @@ type Async struct {
 	asyncFn AsyncFn
 }
 
+// GoAsync ((Error -> Unit) -> (a -> Unit) -> Canceler), see MakeGoAsync
+type GoAsync struct {
+	fn func(onError func(Any), onSuccess func(Any)) Canceler
+}
+
 // forall b. Bind (Aff b) (b -> Aff a)
 type Bind struct {
 	affOfB Any
@@ -78,6 +510,7 @@ type Bracket struct {
 	acquire           Any
 	bracketConditions Dict
 	withResource      func(Any) Any
+	location          string // in debug mode
 }
 
 // forall b. Fork Boolean (Aff b) ?(Fiber b -> a)
@@ -101,6 +534,7 @@ type Resume struct {
 type Release struct {
 	bracketConditions Dict
 	result            Any
+	location          string
 }
 
 type Finalizer struct {
@@ -169,12 +603,423 @@ const PENDING = 4     // An async effect is running.
 const RETURN = 5      // The current stack has returned.
 const COMPLETED = 6   // The entire fiber has completed.
 
+// inherited is what a fiber passes on to the fibers it starts
+type inherited struct {
+	trace  *fiberTrace // the parent, in debug mode
+	locals *localFrame
+}
+
+// fiberTrace is what debug mode records about a fiber
+type fiberTrace struct {
+	id           int64
+	parent       int64
+	status       string
+	waitingOn    string
+	brackets     []string
+	created      time.Time
+	pendingSince time.Time
+	pendingTotal time.Duration
+	kill         func(Any, Any) Any // the fiber's kill, for test mode
+}
+
+// fiberRegistry holds the fibers started while debug mode is on, until they
+// complete
+type fiberRegistry struct {
+	mu      sync.Mutex
+	enabled bool
+	nextID  int64
+	fibers  map[int64]*fiberTrace
+}
+
+var fiberDebug = &fiberRegistry{fibers: map[int64]*fiberTrace{}}
+
+// EnableFiberDebug turns fiber tracking on or off. Only fibers created while
+// it is on are tracked.
+func EnableFiberDebug(on bool) {
+	fiberDebug.mu.Lock()
+	defer fiberDebug.mu.Unlock()
+	fiberDebug.enabled = on
+	if !on {
+		fiberDebug.fibers = map[int64]*fiberTrace{}
+	}
+}
+
+// track registers a new fiber, returning nil when debug mode is off
+func (r *fiberRegistry) track(parent *fiberTrace) *fiberTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.enabled {
+		return nil
+	}
+	r.nextID++
+	t := &fiberTrace{id: r.nextID, status: "SUSPENDED", created: time.Now()}
+	if parent != nil {
+		t.parent = parent.id
+	}
+	r.fibers[t.id] = t
+	return t
+}
+
+// resume records that the fiber is running
+func (t *fiberTrace) resume() {
+	if t == nil {
+		return
+	}
+	fiberDebug.mu.Lock()
+	defer fiberDebug.mu.Unlock()
+	if t.status == "PENDING" {
+		t.pendingTotal += time.Since(t.pendingSince)
+	}
+	t.status = "RUNNING"
+	t.waitingOn = ""
+}
+
+// pend records that the fiber is waiting for an async effect, inside the
+// given bracket stages
+func (t *fiberTrace) pend(waitingOn string, brackets []string) {
+	if t == nil {
+		return
+	}
+	fiberDebug.mu.Lock()
+	defer fiberDebug.mu.Unlock()
+	t.status = "PENDING"
+	t.waitingOn = waitingOn
+	t.brackets = append([]string(nil), brackets...)
+	t.pendingSince = time.Now()
+}
+
+// bracketStage describes what a fiber is doing in a bracket, where the
+// bracket's location is known (see bracketLocation)
+func bracketStage(stage string, location string) string {
+	if location == "" {
+		return stage + " a bracket"
+	}
+	return stage + " the bracket at " + location
+}
+
+// bracketLocation finds the code that created a bracket, skipping the Go
+// runtime and Effect.Aff, while debug mode is on
+func bracketLocation() string {
+	fiberDebug.mu.Lock()
+	enabled := fiberDebug.enabled
+	fiberDebug.mu.Unlock()
+	if !enabled {
+		return ""
+	}
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := exceptions.FrameName(frame)
+		inAff := strings.HasPrefix(name, "Effect.Aff.") ||
+			strings.HasPrefix(frame.Function, affPackage) && !strings.HasSuffix(frame.File, "_test.go")
+		if !inAff && !strings.HasPrefix(name, "runtime.") &&
+			!strings.HasPrefix(frame.Function, "github.com/purescript-native/go-runtime.") {
+			return fmt.Sprintf("%s (%s:%d)", name, frame.File, frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// affPackage prefixes the names of this package's functions
+const affPackage = "github.com/i-am-the-slime/go-ffi/purescript-aff."
+
+// done removes a completed fiber
+func (t *fiberTrace) done() {
+	if t == nil {
+		return
+	}
+	fiberDebug.mu.Lock()
+	defer fiberDebug.mu.Unlock()
+	delete(fiberDebug.fibers, t.id)
+}
+
+// FiberInfo describes a fiber tracked in debug mode. Durations are in
+// nanoseconds when encoded as JSON.
+type FiberInfo struct {
+	ID        int64  `json:"id"`
+	Parent    int64  `json:"parent,omitempty"` // 0 for a launched fiber
+	Status    string `json:"status"`           // SUSPENDED, RUNNING or PENDING
+	WaitingOn string `json:"waitingOn,omitempty"`
+	Brackets  int    `json:"brackets"` // brackets being acquired or released
+	// What the fiber is doing in each of those brackets, outermost first,
+	// e.g. "releasing (killed) the bracket at Main.withConnection (...)"
+	BracketStages []string      `json:"bracketStages,omitempty"`
+	Age           time.Duration `json:"age"`
+	PendingFor    time.Duration `json:"pendingFor"`
+	PendingTotal  time.Duration `json:"pendingTotal"`
+}
+
+// FiberSnapshot lists the fibers that haven't completed, oldest first
+func FiberSnapshot() []FiberInfo {
+	fiberDebug.mu.Lock()
+	defer fiberDebug.mu.Unlock()
+	now := time.Now()
+	infos := make([]FiberInfo, 0, len(fiberDebug.fibers))
+	for _, t := range fiberDebug.fibers {
+		info := FiberInfo{
+			ID:            t.id,
+			Parent:        t.parent,
+			Status:        t.status,
+			WaitingOn:     t.waitingOn,
+			Brackets:      len(t.brackets),
+			BracketStages: t.brackets,
+			Age:           now.Sub(t.created),
+			PendingTotal:  t.pendingTotal,
+		}
+		if t.status == "PENDING" {
+			info.PendingFor = now.Sub(t.pendingSince)
+			info.PendingTotal += info.PendingFor
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// DumpFibers describes the fibers that haven't completed as a tree, each
+// fiber under the one that forked it
+func DumpFibers() string {
+	infos := FiberSnapshot()
+	children := map[int64][]FiberInfo{}
+	known := map[int64]bool{}
+	for _, info := range infos {
+		known[info.ID] = true
+	}
+	var roots []FiberInfo
+	for _, info := range infos {
+		if known[info.Parent] {
+			children[info.Parent] = append(children[info.Parent], info)
+		} else {
+			roots = append(roots, info)
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "%d fibers\n", len(infos))
+	var write func(info FiberInfo, depth int)
+	write = func(info FiberInfo, depth int) {
+		fmt.Fprintf(&out, "%sfiber %d %s", strings.Repeat("  ", depth), info.ID, info.Status)
+		if info.Status == "PENDING" {
+			fmt.Fprintf(&out, " on %s for %v", info.WaitingOn, info.PendingFor.Round(time.Millisecond))
+		}
+		fmt.Fprintf(&out, ", pending %v of %v", info.PendingTotal.Round(time.Millisecond), info.Age.Round(time.Millisecond))
+		if info.Brackets > 0 {
+			fmt.Fprintf(&out, ", in %d bracket(s): %s", info.Brackets, strings.Join(info.BracketStages, ", within "))
+		}
+		if depth == 0 && info.Parent != 0 {
+			fmt.Fprintf(&out, ", parent %d completed", info.Parent)
+		}
+		out.WriteString("\n")
+		for _, child := range children[info.ID] {
+			write(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		write(root, 0)
+	}
+	return out.String()
+}
+
+// affTest is the state of test mode, see StartTestMode
+type affTest struct {
+	mu          sync.Mutex
+	on          bool
+	deadline    time.Duration
+	debugWas    bool
+	supervisors []func() int // live children of each supervisor
+	reports     []string
+}
+
+var testMode = &affTest{}
+
+// TB is the part of testing.TB that CheckLeaks uses
+type TB interface {
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...interface{})
+}
+
+// CheckLeaks puts the Aff runtime in test mode for the rest of t, failing
+// it with a report of anything launchAff left behind
+func CheckLeaks(t TB, deadline time.Duration) {
+	t.Helper()
+	StartTestMode(deadline)
+	t.Cleanup(func() {
+		if err := StopTestMode(); err != nil {
+			t.Errorf("%v", err)
+		}
+	})
+}
+
+// StartTestMode makes launchAff wait at most deadline for the work it
+// starts. Fibers that haven't completed by then are reported, along with
+// timers still armed and supervisors with live children, and then killed
+// so later tests start clean. Fiber debug mode is on while in test mode.
+func StartTestMode(deadline time.Duration) {
+	fiberDebug.mu.Lock()
+	debugWas := fiberDebug.enabled
+	fiberDebug.mu.Unlock()
+	EnableFiberDebug(true)
+
+	testMode.mu.Lock()
+	defer testMode.mu.Unlock()
+	testMode.on = true
+	testMode.deadline = deadline
+	testMode.debugWas = debugWas
+	testMode.supervisors = nil
+	testMode.reports = nil
+}
+
+// StopTestMode leaves test mode, returning an error with the reports made
+// since StartTestMode, including anything still left over now
+func StopTestMode() error {
+	testMode.check("after the test")
+	testMode.mu.Lock()
+	reports := testMode.reports
+	testMode.on = false
+	testMode.supervisors = nil
+	testMode.reports = nil
+	debugWas := testMode.debugWas
+	testMode.mu.Unlock()
+	EnableFiberDebug(debugWas)
+
+	if len(reports) == 0 {
+		return nil
+	}
+	return errors.New("Aff leak check failed:\n" + strings.Join(reports, "\n"))
+}
+
+// LeakReport describes what the runtime has leaked so far in test mode, or
+// returns "" if nothing has. Call it after launchAff returns, not from a
+// fiber, which would count as leaked itself.
+func LeakReport() string {
+	testMode.check("at the leak check")
+	testMode.mu.Lock()
+	defer testMode.mu.Unlock()
+	return strings.Join(testMode.reports, "\n")
+}
+
+func (m *affTest) deadlineSet() (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deadline, m.on
+}
+
+// watch adds a supervisor to report if it still has live children
+func (m *affTest) watch(children func() int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.on {
+		m.supervisors = append(m.supervisors, children)
+	}
+}
+
+// runLoop runs the event loop for a launched fiber, checking for leaks if
+// it isn't idle by the deadline
+func (m *affTest) runLoop(deadline time.Duration) {
+	if !runFor(deadline) {
+		m.check(fmt.Sprintf("when launchAff gave up after %v", deadline))
+	}
+}
+
+// runFor runs the event loop until it is idle, reporting false if deadline
+// passed first
+func runFor(deadline time.Duration) bool {
+	var expired int32
+	timer := time.AfterFunc(deadline, func() {
+		atomic.StoreInt32(&expired, 1)
+		// Wake the loop so it notices
+		loop.push(func() Any { return nil })
+	})
+	loop.runUntil(func() bool { return atomic.LoadInt32(&expired) == 1 })
+	timer.Stop()
+	return atomic.LoadInt32(&expired) == 0
+}
+
+// check reports and kills whatever is left over
+func (m *affTest) check(when string) {
+	var lines []string
+	infos := FiberSnapshot()
+	if len(infos) > 0 {
+		lines = append(lines, fmt.Sprintf("  %d fibers never completed:", len(infos)))
+		dump := strings.TrimSuffix(DumpFibers(), "\n")
+		for _, line := range strings.Split(dump, "\n")[1:] {
+			lines = append(lines, "    "+line)
+		}
+	}
+	if n := atomic.LoadInt64(&armedTimers); n > 0 {
+		lines = append(lines, fmt.Sprintf("  %d timers still armed", n))
+	}
+	m.mu.Lock()
+	for i, children := range m.supervisors {
+		if n := children(); n > 0 {
+			lines = append(lines, fmt.Sprintf("  supervisor %d has %d live children", i+1, n))
+		}
+	}
+	m.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	m.reports = append(m.reports, when+":\n"+strings.Join(lines, "\n"))
+	deadline := m.deadline
+	m.mu.Unlock()
+	m.killLeaked(deadline)
+}
+
+// killLeaked kills the tracked fibers, giving their finalizers until
+// deadline to run, then forgets them
+func (m *affTest) killLeaked(deadline time.Duration) {
+	fiberDebug.mu.Lock()
+	var kills []func(Any, Any) Any
+	for _, t := range fiberDebug.fibers {
+		if t.kill != nil {
+			kills = append(kills, t.kill)
+		}
+	}
+	fiberDebug.mu.Unlock()
+
+	leaked := errors.New("killed by the Aff leak check")
+	for _, kill := range kills {
+		Run(kill(leaked, func(Any) func() Any {
+			return func() Any { return nil }
+		}))
+	}
+	runFor(deadline)
+
+	fiberDebug.mu.Lock()
+	fiberDebug.fibers = map[int64]*fiberTrace{}
+	fiberDebug.mu.Unlock()
+}
+
+// FiberDebugHandler serves DumpFibers, or FiberSnapshot as JSON with
+// ?format=json
+func FiberDebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(FiberSnapshot())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, DumpFibers())
+	})
+}
+
 func nonCanceler(error Any) Any {
 	return Pure{value: Dict{}}
 }
 
 func runSync(left func(Any) Any, right func(Any) Any, eff func() Any) Any {
-	return right(eff())
+	value, err := exceptions.Recover(eff)
+	if err != nil {
+		return left(err)
+	}
+	return right(value)
 }
 
 func runAsync(
@@ -188,16 +1033,21 @@ func runAsync(
 	if asyncFn == nil {
 		panic("runAsync: asyncFn is nil")
 	}
-	
-	// Apply asyncFn to cb, returning an Effect Canceler
-	part := Apply(asyncFn, cb)
-	if part == nil {
-		panic("[runAsync] Apply(asyncFn, cb) returned nil!")
-	}
 
-	// Run the Effect to get the Canceler
-	result := Run(part)
-	return result
+	// Apply asyncFn to cb and run the Effect to get the Canceler. A panic
+	// fails the fiber, as it does in runSync
+	canceler, err := exceptions.Recover(func() Any {
+		part := Apply(asyncFn, cb)
+		if part == nil {
+			panic("[runAsync] Apply(asyncFn, cb) returned nil!")
+		}
+		return Run(part)
+	})
+	if err != nil {
+		Run(callbackEffect(cb, left(err)))
+		return nonCanceler
+	}
+	return canceler
 }
 
 // function sequential(util, supervisor, par) {
@@ -208,14 +1058,185 @@ func runAsync(
 //     });
 //   }
 
-func sequential(util Any, supervisor Any, par Any) Async {
+func sequential(util Any, supervisor Any, par Any, from inherited) Async {
 	return Async{asyncFn: func(cb Any /*AsyncCallback*/) Any {
 		return func() Canceler {
-			return runPar(util, supervisor, par, cb)
+			return runPar(util, supervisor, par, cb, from)
 		}
 	}}
 }
 
+// Locals replaces the fiber's locals with update applied to them, resuming
+// with the locals it replaced
+type Locals struct {
+	update func(*localFrame) *localFrame
+}
+
+// ParTraverseN runs f over items in child fibers, at most n at a time
+type ParTraverseN struct {
+	n       int
+	f       func(Any) Any
+	items   []Any
+	discard bool // resume with unit rather than the results
+}
+
+// MakeParTraverseN creates an Aff that runs f over items with at most n
+// running at once, resuming with the results in order
+func MakeParTraverseN(n int, f func(Any) Any, items []Any) Any {
+	if n < 1 {
+		return MakeThrow(fmt.Errorf("parTraverseN needs a limit of at least 1, got %d", n))
+	}
+	return ParTraverseN{n: n, f: f, items: items}
+}
+
+func parTraverseN(util Any, supervisor Any, t ParTraverseN, from inherited) Async {
+	return Async{asyncFn: func(cb Any) Any {
+		return func() Any {
+			return runTraverseN(util, supervisor, t, cb, from)
+		}
+	}}
+}
+
+// runTraverseN starts a fiber for each item as earlier ones finish. The
+// first failure kills the fibers still running, then fails the traversal.
+func runTraverseN(util Any, supervisor Any, t ParTraverseN, cb Any, from inherited) Canceler {
+	utilDict := util.(Dict)
+	isLeft := utilDict["isLeft"].(func(Any) Any)
+	fromRight := utilDict["fromRight"].(func(Any) Any)
+	right := utilDict["right"].(func(Any) Any)
+
+	var mu sync.Mutex
+	results := make([]Any, len(t.items))
+	running := map[int]Dict{}
+	next := 0
+	remaining := len(t.items)
+	finished := false
+	starting := false
+
+	complete := func(result Any) {
+		Run(callbackEffect(cb, result))
+	}
+
+	// killRunning kills every running fiber, calling done once all have stopped
+	killRunning := func(err Any, done func()) {
+		mu.Lock()
+		fibers := make([]Dict, 0, len(running))
+		for _, fiber := range running {
+			fibers = append(fibers, fiber)
+		}
+		mu.Unlock()
+		count := len(fibers)
+		if count == 0 {
+			done()
+			return
+		}
+		for _, fiber := range fibers {
+			killFn := fiber["kill"].(func(Any, Any) Any)
+			Run(killFn(err, func(Any) func() Any {
+				return func() Any {
+					mu.Lock()
+					count--
+					last := count == 0
+					mu.Unlock()
+					if last {
+						done()
+					}
+					return nil
+				}
+			}))
+		}
+	}
+
+	var start func()
+	resolve := func(index int) func(Any) func() Any {
+		return func(result Any) func() Any {
+			return func() Any {
+				mu.Lock()
+				delete(running, index)
+				if finished {
+					mu.Unlock()
+					return nil
+				}
+				if isLeft(result).(bool) {
+					finished = true
+					mu.Unlock()
+					killRunning(fmt.Errorf("[ParTraverseN] Early exit"), func() { complete(result) })
+					return nil
+				}
+				if !t.discard {
+					results[index] = fromRight(result)
+				}
+				remaining--
+				if remaining == 0 {
+					finished = true
+					mu.Unlock()
+					if t.discard {
+						complete(right(nil))
+					} else {
+						complete(right(results))
+					}
+					return nil
+				}
+				mu.Unlock()
+				start()
+				return nil
+			}
+		}
+	}
+
+	// start fills the free slots. Fibers that finish while it runs free
+	// their slot for the same loop, rather than starting another one.
+	start = func() {
+		mu.Lock()
+		if starting {
+			mu.Unlock()
+			return
+		}
+		starting = true
+		for !finished && next < len(t.items) && len(running) < t.n {
+			index := next
+			next++
+			fiber := newFiber(util, supervisor, t.f(t.items[index]), from).(Dict)
+			running[index] = fiber
+			mu.Unlock()
+
+			onComplete := fiber["onComplete"].(func(OnComplete) func() Any)
+			onComplete(OnComplete{rethrow: false, handler: resolve(index)})()
+			if supervisor != nil {
+				supervisor.(Dict)["register"].(func(Any))(fiber)
+			}
+			Run(fiber["run"])
+			mu.Lock()
+		}
+		starting = false
+		mu.Unlock()
+	}
+
+	if len(t.items) == 0 {
+		if t.discard {
+			complete(right(nil))
+		} else {
+			complete(right(results))
+		}
+		return nonCanceler
+	}
+	start()
+
+	return func(killError Any) Any {
+		return Async{asyncFn: func(killCb Any) Any {
+			return func() Any {
+				mu.Lock()
+				finished = true
+				mu.Unlock()
+				killRunning(killError, func() {
+					Run(callbackEffect(killCb, right(nil)))
+				})
+				return nonCanceler
+			}
+		}}
+	}
+}
+
 // Forked represents a leaf node in the parallel tree
 type Forked struct {
 	fid    int
@@ -225,7 +1246,7 @@ type Forked struct {
 
 var EMPTY = struct{}{}
 
-func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
+func runPar(util Any, supervisor Any, par Any, cb Any, from inherited) Canceler {
 	utilDict := util.(Dict)
 	isLeft := utilDict["isLeft"].(func(Any) Any)
 	fromRight := utilDict["fromRight"].(func(Any) Any)
@@ -238,10 +1259,10 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 	fibers := make(map[int]Any)
 	killId := 0
 	kills := make(map[int]map[int]Any)
-	
+
 	// Early exit error for Alt cancellation
 	earlyExit := fmt.Errorf("[ParAff] Early exit")
-	
+
 	var interrupt Any = nil
 	var root Any = EMPTY
 
@@ -253,44 +1274,40 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 		var tail *Cons = nil
 		count := 0
 		killsMap := make(map[int]Any)
-		
+
 		for {
 			switch currentStep := step.(type) {
 			case *Forked:
 				if currentStep.result == EMPTY {
 					mu.Lock()
-					if fiber, ok := fibers[currentStep.fid]; ok {
+					fiber, ok := fibers[currentStep.fid]
+					mu.Unlock()
+					if ok {
 						idx := count
 						count++
 						fiberDict := fiber.(Dict)
 						killFn := fiberDict["kill"].(func(Any, Any) Any)
-						// Call killFn to get the effect, then call the effect to get the canceler
-						killEffect := killFn(killError, func(result Any) func() Any {
+						// The kill effect runs once the whole subtree has been visited
+						killsMap[idx] = killFn(killError, func(result Any) func() Any {
 							return func() Any {
 								mu.Lock()
 								count--
-								if count == 0 {
-									mu.Unlock()
+								last := count == 0
+								mu.Unlock()
+								if last {
 									cb(result)()
-								} else {
-									mu.Unlock()
 								}
 								return nil
 							}
 						})
-						// Execute the effect to get the canceler
-						if effectFn, ok := killEffect.(func() Any); ok {
-							killsMap[idx] = effectFn()
-						}
 					}
-					mu.Unlock()
 				}
-				
+
 				// Terminal case
 				if head == nil {
 					goto done
 				}
-				
+
 				// Go down the right side of the tree
 				switch h := head.(type) {
 				case *ParApply:
@@ -300,7 +1317,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 				default:
 					goto done
 				}
-				
+
 				// Move to next head from stack
 				if tail == nil {
 					head = nil
@@ -308,41 +1325,43 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 					head = tail.head
 					tail = tail.tail
 				}
-				
+
 			case *ParMap:
 				step = currentStep.parAffOfB
-				
+
 			case *ParApply:
 				if head != nil {
 					tail = &Cons{head: head, tail: tail}
 				}
 				head = step
 				step = currentStep.parAffOfBToA
-				
+
 			case *ParAlt:
 				if head != nil {
 					tail = &Cons{head: head, tail: tail}
 				}
 				head = step
 				step = currentStep.option1
-			
+
 			default:
 				goto done
 			}
 		}
-		
+
 	done:
 		if count == 0 {
 			cb(right(nil))()
 		} else {
-			// Run all cancellation effects and store the resulting cancelers
-			for i := 0; i < count; i++ {
-				if cancelFn, ok := killsMap[i].(func() Any); ok {
-					killsMap[i] = cancelFn()
+			// Run the kill effects, keeping the cancelers they return. count
+			// changes as fibers complete, so it is copied first.
+			total := count
+			for i := 0; i < total; i++ {
+				if killEffect, ok := killsMap[i].(func() Any); ok {
+					killsMap[i] = killEffect()
 				}
 			}
 		}
-		
+
 		return killsMap
 	}
 
@@ -363,12 +1382,53 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 		}
 	}
 
-	// join bubbles results back up the tree
-	var join func(result Any, head Any, tail *Cons)
-	join = func(result Any, head Any, tail *Cons) {
+	// killSibling kills the other side of a node that has been decided,
+	// then joins result further up the tree. It returns true if the kill
+	// finished synchronously and the caller should carry on joining itself.
+	var join func(result Any, from Any, head Any, tail *Cons)
+	killSibling := func(result Any, sibling Any, head Any, tail *Cons) bool {
+		mu.Lock()
+		kid := killId
+		killId++
+		mu.Unlock()
+
+		pending := true
+		innerKills := kill(earlyExit, sibling, func(Any) func() Any {
+			return func() Any {
+				mu.Lock()
+				delete(kills, kid)
+				wasPending := pending
+				pending = false
+				mu.Unlock()
+				if wasPending {
+					return nil
+				}
+				if tail == nil {
+					join(result, head, nil, nil)
+				} else {
+					join(result, head, tail.head, tail.tail)
+				}
+				return nil
+			}
+		})
+
+		mu.Lock()
+		defer mu.Unlock()
+		if pending {
+			// The callback joins once the sibling has stopped
+			pending = false
+			kills[kid] = innerKills
+			return false
+		}
+		return true
+	}
+
+	// join bubbles results back up the tree. from is the node that produced
+	// result, a child of head.
+	join = func(result Any, from Any, head Any, tail *Cons) {
 		var fail Any
 		var step Any
-		
+
 		if isLeft(result).(bool) {
 			fail = result
 			step = nil
@@ -376,7 +1436,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 			step = result
 			fail = nil
 		}
-		
+
 		for {
 			mu.Lock()
 			if interrupt != nil {
@@ -384,7 +1444,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 				return
 			}
 			mu.Unlock()
-			
+
 			// Reached root
 			if head == nil {
 				if fail != nil {
@@ -394,15 +1454,9 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 				}
 				return
 			}
-			
-			// Check if already computed (with double-checked locking)
-			if getResult(head) != EMPTY {
-				return
-			}
-			
+
 			switch h := head.(type) {
 			case *ParMap:
-				// Lock to prevent race when multiple fibers complete simultaneously
 				mu.Lock()
 				if h.result != EMPTY {
 					// Already computed by another fiber
@@ -410,119 +1464,60 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 					return
 				}
 				if fail == nil {
-					mapped := right(h.bToA(fromRight(step)))
-					h.result = mapped
-					step = mapped
+					step = right(h.bToA(fromRight(step)))
+					h.result = step
 				} else {
 					h.result = fail
 				}
 				mu.Unlock()
-				
+
 			case *ParApply:
 				mu.Lock()
 				if h.result != EMPTY {
-					// Already computed by another fiber
 					mu.Unlock()
 					return
 				}
 				lhs := getResult(h.parAffOfBToA)
 				rhs := getResult(h.parAffOfB)
-				mu.Unlock()
-				
 				if fail != nil {
-					// Set result under lock
-					mu.Lock()
-					if h.result != EMPTY {
-						mu.Unlock()
-						return
-					}
 					h.result = fail
-					kid := killId
-					killId++
-					var toKill Any
-					if fail == lhs {
-						toKill = h.parAffOfB
-					} else {
-						toKill = h.parAffOfBToA
-					}
 					mu.Unlock()
-					
-					// Kill the other side (without holding mutex)
-					done := false
-					currentKid := kid
-					innerKills := kill(earlyExit, toKill, func(Any) func() Any {
-						return func() Any {
-							mu.Lock()
-							delete(kills, currentKid)
-							mu.Unlock()
-							if !done {
-								done = true
-								return nil
-							}
-							if tail == nil {
-								join(fail, nil, nil)
-							} else {
-								join(fail, tail.head, tail.tail)
-							}
-							return nil
-						}
-					})
-					
-					mu.Lock()
-					kills[currentKid] = innerKills
-					mu.Unlock()
-					
-					if done {
-						// Kill completed synchronously, callback will handle join
+					sibling := h.parAffOfBToA
+					if from == h.parAffOfBToA {
+						sibling = h.parAffOfB
+					}
+					if !killSibling(fail, sibling, head, tail) {
 						return
 					}
-					// Kill is pending, we return and wait for callback
-					return
 				} else if lhs == EMPTY || rhs == EMPTY {
 					// Can't proceed yet
+					mu.Unlock()
 					return
 				} else {
-					// Apply the function
-					mu.Lock()
-					if h.result != EMPTY {
-						mu.Unlock()
-						return
-					}
 					fn := fromRight(lhs).(func(Any) Any)
-					arg := fromRight(rhs)
-					applied := right(fn(arg))
-					h.result = applied
-					step = applied
+					step = right(fn(fromRight(rhs)))
+					h.result = step
 					mu.Unlock()
 				}
-				
+
 			case *ParAlt:
 				mu.Lock()
 				if h.result != EMPTY {
-					// Already computed by another fiber
 					mu.Unlock()
 					return
 				}
 				lhs := getResult(h.option1)
 				rhs := getResult(h.option2)
-				mu.Unlock()
-				
-				// Wait for at least one side or both errors
-				if lhs == EMPTY && (rhs == EMPTY || !isLeft(rhs).(bool)) {
-					return
-				}
-				if rhs == EMPTY && (lhs == EMPTY || !isLeft(lhs).(bool)) {
+
+				// Proceed once either side succeeds or both have failed
+				if (lhs == EMPTY && isLeft(rhs).(bool)) || (rhs == EMPTY && isLeft(lhs).(bool)) {
+					mu.Unlock()
 					return
 				}
-				
-				// Both errors - use first
+
 				if lhs != EMPTY && isLeft(lhs).(bool) && rhs != EMPTY && isLeft(rhs).(bool) {
-					mu.Lock()
-					if h.result != EMPTY {
-						mu.Unlock()
-						return
-					}
-					if step == lhs {
+					// Both failed: continue with the first error
+					if from == h.option1 {
 						fail = rhs
 					} else {
 						fail = lhs
@@ -531,58 +1526,21 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 					h.result = fail
 					mu.Unlock()
 				} else {
-					// One succeeded - use it and kill the other
-					mu.Lock()
-					if h.result != EMPTY {
-						mu.Unlock()
-						return
-					}
+					// One side succeeded: use it and kill the other
 					h.result = step
-					kid := killId
-					killId++
-					var toKill Any
-					if step == lhs {
-						toKill = h.option2
-					} else {
-						toKill = h.option1
-					}
 					mu.Unlock()
-					
-					// Kill the other side (without holding mutex)
-					done := false
-					currentKid := kid
-					innerKills := kill(earlyExit, toKill, func(Any) func() Any {
-						return func() Any {
-							mu.Lock()
-							delete(kills, currentKid)
-							mu.Unlock()
-							if !done {
-								done = true
-								return nil
-							}
-							if tail == nil {
-								join(step, nil, nil)
-							} else {
-								join(step, tail.head, tail.tail)
-							}
-							return nil
-						}
-					})
-					
-					mu.Lock()
-					kills[currentKid] = innerKills
-					mu.Unlock()
-					
-					if done {
-						// Kill completed synchronously, callback will handle join
+					sibling := h.option1
+					if from == h.option1 {
+						sibling = h.option2
+					}
+					if !killSibling(step, sibling, head, tail) {
 						return
 					}
-					// Kill is pending, we return and wait for callback
-					return
 				}
 			}
-			
+
 			// Move up the tree
+			from = head
 			if tail == nil {
 				head = nil
 			} else {
@@ -605,8 +1563,8 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 					resumeTail = forked.resume.tail
 				}
 				mu.Unlock()
-				
-				join(result, resumeHead, resumeTail)
+
+				join(result, forked, resumeHead, resumeTail)
 				return nil
 			}
 		}
@@ -618,12 +1576,12 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 			RUN_CONTINUE = 1
 			RUN_RETURN   = 2
 		)
-		
+
 		status := RUN_CONTINUE
 		step := par
 		var head Any = nil
 		var tail *Cons = nil
-		
+
 		for {
 			switch status {
 			case RUN_CONTINUE:
@@ -634,63 +1592,62 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 					}
 					head = &ParMap{bToA: currentStep.bToA, parAffOfB: EMPTY, result: EMPTY}
 					step = currentStep.parAffOfB
-					
+
 				case ParApply:
 					if head != nil {
 						tail = &Cons{head: head, tail: tail}
 					}
 					head = &ParApply{parAffOfBToA: EMPTY, parAffOfB: currentStep.parAffOfB, result: EMPTY}
 					step = currentStep.parAffOfBToA
-					
+
 				case ParAlt:
 					if head != nil {
 						tail = &Cons{head: head, tail: tail}
 					}
 					head = &ParAlt{option1: EMPTY, option2: currentStep.option2, result: EMPTY}
 					step = currentStep.option1
-					
+
 				default:
 					// Leaf node - create a fiber
 					mu.Lock()
 					fid := fiberId
 					fiberId++
 					mu.Unlock()
-					
-					
+
 					forked := &Forked{
 						fid:    fid,
 						resume: &Cons{head: head, tail: tail},
 						result: EMPTY,
 					}
-					
-					fiber := Fiber(util, supervisor, step)
+
+					fiber := newFiber(util, supervisor, step, from)
 					fiberDict := fiber.(Dict)
 					onCompleteFn := fiberDict["onComplete"].(func(OnComplete) func() Any)
 					onCompleteFn(OnComplete{
 						rethrow: false,
 						handler: resolve(forked),
 					})()
-					
+
 					mu.Lock()
 					fibers[fid] = fiber
 					mu.Unlock()
-					
+
 					if supervisor != nil {
 						supervisorDict := supervisor.(Dict)
 						registerFn := supervisorDict["register"].(func(Any))
 						registerFn(fiber)
 					}
-					
+
 					status = RUN_RETURN
 					step = forked
 				}
-				
+
 			case RUN_RETURN:
 				// Terminal case
 				if head == nil {
 					goto done
 				}
-				
+
 				// Fill in the left side
 				switch h := head.(type) {
 				case *ParMap:
@@ -714,7 +1671,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 							tail = tail.tail
 						}
 					}
-					
+
 				case *ParApply:
 					if h.parAffOfBToA == EMPTY {
 						h.parAffOfBToA = step
@@ -730,7 +1687,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 							tail = tail.tail
 						}
 					}
-					
+
 				case *ParAlt:
 					if h.option1 == EMPTY {
 						h.option1 = step
@@ -749,11 +1706,10 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 				}
 			}
 		}
-		
+
 	done:
 		root = step
-		
-		
+
 		// Start all fibers
 		mu.Lock()
 		fibersCopy := make(map[int]Any)
@@ -761,7 +1717,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 			fibersCopy[k] = v
 		}
 		mu.Unlock()
-		
+
 		for _, fiber := range fibersCopy {
 			fiberDict := fiber.(Dict)
 			runFn := fiberDict["run"].(func() interface{})
@@ -773,7 +1729,7 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 	cancel := func(cancelError Any, cb func(Any) func() Any) Any {
 		mu.Lock()
 		interrupt = left(cancelError)
-		
+
 		// Cancel all pending kills
 		for _, innerKills := range kills {
 			for _, killFn := range innerKills {
@@ -784,9 +1740,9 @@ func runPar(util Any, supervisor Any, par Any, cb Any) Canceler {
 		}
 		kills = make(map[int]map[int]Any)
 		mu.Unlock()
-		
+
 		newKills := kill(cancelError, root, cb)
-		
+
 		return func(killError Any) Any {
 			return Async{asyncFn: func(killCb Any) Any {
 				return func() Any {
@@ -824,19 +1780,19 @@ func SupervisorNew(util Any) Any {
 	utilDict := util.(Dict)
 	isLeft := utilDict["isLeft"].(func(Any) Any)
 	fromLeft := utilDict["fromLeft"].(func(Any) Any)
-	
+
 	var mu sync.Mutex
 	fibers := make(map[int]Any)
 	fiberId := 0
 	count := 0
-	
+
 	register := func(fiber Any) {
 		mu.Lock()
 		defer mu.Unlock()
-		
+
 		fid := fiberId
 		fiberId++
-		
+
 		fiberDict := fiber.(Dict)
 		onCompleteFn := fiberDict["onComplete"].(func(OnComplete) func() Any)
 		onCompleteFn(OnComplete{
@@ -851,17 +1807,22 @@ func SupervisorNew(util Any) Any {
 				}
 			},
 		})()
-		
+
 		fibers[fid] = fiber
 		count++
 	}
-	
+
 	isEmpty := func() Any {
 		mu.Lock()
 		defer mu.Unlock()
 		return count == 0
 	}
-	
+	testMode.watch(func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	})
+
 	killAll := func(killError Any, cb func()) func() Any {
 		return func() Any {
 			mu.Lock()
@@ -870,25 +1831,25 @@ func SupervisorNew(util Any) Any {
 				cb()
 				return nil
 			}
-			
+
 			killCount := 0
 			kills := make(map[int]Any)
 			fibersCopy := make(map[int]Any)
 			for k, v := range fibers {
 				fibersCopy[k] = v
 			}
-			
+
 			// Clear state
 			fibers = make(map[int]Any)
 			fiberId = 0
 			count = 0
 			mu.Unlock()
-			
+
 			// Kill each fiber
 			for fid, fiber := range fibersCopy {
 				fiberDict := fiber.(Dict)
 				killFn := fiberDict["kill"].(func(Any, Any) Any)
-				
+
 				currentFid := fid
 				// killFn returns func() Any, which when called returns the canceler
 				killEffect := killFn(killError, func(result Any) func() Any {
@@ -905,7 +1866,7 @@ func SupervisorNew(util Any) Any {
 						}
 						shouldCallback := killCount == 0
 						mu.Unlock()
-						
+
 						if shouldCallback {
 							cb()
 						}
@@ -922,7 +1883,7 @@ func SupervisorNew(util Any) Any {
 				killCount++
 				mu.Unlock()
 			}
-			
+
 			// Return canceler for the killAll operation
 			return func(error Any) Any {
 				return Sync{eff: func() Any {
@@ -938,7 +1899,7 @@ func SupervisorNew(util Any) Any {
 			}
 		}
 	}
-	
+
 	return Dict{
 		"register": register,
 		"isEmpty":  isEmpty,
@@ -946,8 +1907,13 @@ func SupervisorNew(util Any) Any {
 	}
 }
 
-
 func Fiber(util_ Any, supervisor Any, aff Any) Any {
+	return newFiber(util_, supervisor, aff, inherited{})
+}
+
+// newFiber creates a fiber that starts with the locals of the fiber that
+// forked it, recorded as its parent in debug mode
+func newFiber(util_ Any, supervisor Any, aff Any, from inherited) Any {
 	var util Dict = util_.(Dict)
 	var isLeft func(Any) Any = func(x Any) Any {
 		return util["isLeft"].(func(Any) Any)(x)
@@ -981,6 +1947,23 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 	var rethrow = true
 
 	status := SUSPENDED
+	live := false // counted by the event loop
+	trace := fiberDebug.track(from.trace)
+	locals := from.locals
+	waitingOn := "" // the step a pending fiber waits on, in debug mode
+
+	// In debug mode, what the fiber is doing in each bracket it's in
+	var bracketStages []string
+	enterBracket := func(stage string) {
+		if trace != nil {
+			bracketStages = append(bracketStages, stage)
+		}
+	}
+	leaveBracket := func() {
+		if trace != nil && len(bracketStages) > 0 {
+			bracketStages = bracketStages[:len(bracketStages)-1]
+		}
+	}
 
 	var run func(int) Any
 	run = func(localRunTick int) Any {
@@ -989,6 +1972,9 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 		var tmp Any
 		var result Any
 		var attempt Any
+		if status != COMPLETED {
+			trace.resume()
+		}
 		for {
 			tmp = nil
 			result = nil
@@ -1001,14 +1987,14 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 				// fmt.Printf("STEP_BIND headFn: %T\n", headFn)
 				// Makeshift try catch block
 				func() {
-					// defer func() {
-					// 	if err := recover(); err != nil {
-					// 		// early return on error
-					// 		status = RETURN
-					// 		fail = left(err)
-					// 		step = nil
-					// 	}
-					// }()
+					defer func() {
+						if r := recover(); r != nil {
+							// early return on error
+							status = RETURN
+							fail = left(exceptions.FromPanic(r))
+							step = nil
+						}
+					}()
 					newStep := headFn(step)
 					// fmt.printf("STEP_BIND result: %T, value: %v\n", newStep, newStep)
 					step = newStep
@@ -1067,31 +2053,49 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 					step = runSync(left, right, currentStep.eff)
 
 				case Async:
-					fmt.Println("\tAsync")
-					fmt.Printf("\tAsyncFn type: %T\n", currentStep.asyncFn)
 					status = PENDING
+					if waitingOn == "" {
+						waitingOn = "Async"
+					}
+					trace.pend(waitingOn, bracketStages)
+					waitingOn = ""
 					step = runAsync(left, currentStep.asyncFn, func(theResult Any) func() Any {
 						return func() Any {
-							if runTick != localRunTick {
-								return nil
-							}
-							runTick++
-					// Create Effect with explicit type and enqueue it
-					var eff EffFn = func() Any {
-								if runTick != localRunTick+1 {
-							return nil
+							// Resume on the event loop, whichever goroutine
+							// the callback was called on
+							loop.push(func() Any {
+								if runTick != localRunTick {
+									return nil
 								}
+								runTick++
 								status = STEP_RESULT
 								step = theResult
 								run(runTick)
-						return nil
-					}
-					Run(eff)
+								return nil
+							})
 							return nil
 						}
 					})
 					return nil
 
+				case GoAsync:
+					// Wrap the plain callbacks with this fiber's Either constructors
+					waitingOn = "GoAsync"
+					status = CONTINUE
+					step = Async{asyncFn: func(cb Any) Any {
+						return func() Any {
+							release := loop.hold()
+							canceler := currentStep.fn(
+								func(err Any) { release(); ResumeAsync(cb, left(err)) },
+								func(value Any) { release(); ResumeAsync(cb, right(value)) },
+							)
+							return func(error Any) Any {
+								release()
+								return Apply(canceler, error)
+							}
+						}
+					}}
+
 				case Throw:
 					// fmt.Println("\tThrow")
 					status = RETURN
@@ -1120,6 +2124,7 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 				case Bracket:
 					// fmt.Println("\tBracket")
 					bracketCount++
+					enterBracket(bracketStage("acquiring", currentStep.location))
 					if b.head == nil {
 						attempts = &InterruptCons{head: step, tail: attempts, interrupt: interrupt}
 					} else {
@@ -1132,20 +2137,30 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 
 				case Fork:
 					status = STEP_RESULT
-					tmp = Fiber(util, supervisor, currentStep.affOfB)
+					tmp = newFiber(util, supervisor, currentStep.affOfB, inherited{trace, locals})
 					if supervisor != nil {
 						supervisor.(Dict)["register"].(func(Any))(tmp)
 					}
 					if currentStep.questionableBool {
-			// Just run the fiber immediately on the same thread
-			// Go channels in the shell command will handle the async part
-			Run(tmp.(Dict)["run"].(func() interface{}))
+						// Just run the fiber immediately on the same thread
+						// Go channels in the shell command will handle the async part
+						Run(tmp.(Dict)["run"].(func() interface{}))
 					}
 					step = util["right"].(func(Any) Any)(tmp)
 				case Sequential:
 					// fmt.Println("\tSequential")
 					status = CONTINUE
-					step = sequential(util, supervisor, currentStep.parAff)
+					waitingOn = "ParAff"
+					step = sequential(util, supervisor, currentStep.parAff, inherited{trace, locals})
+				case Locals:
+					status = STEP_RESULT
+					step = right(locals)
+					locals = currentStep.update(locals)
+
+				case ParTraverseN:
+					status = CONTINUE
+					waitingOn = "ParTraverseN"
+					step = parTraverseN(util, supervisor, currentStep, inherited{trace, locals})
 				case func() Any:
 					// fmt.println("Step is a function, executing it")
 					step = step.(func() Any)() // Execute the function and get the result
@@ -1205,15 +2220,17 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 					case Bracket:
 						// fmt.println("\tBracket")
 						bracketCount--
+						leaveBracket()
 						if fail == nil {
 							result = fromRight(step)
 							attempts = &InterruptCons{
 								head: Release{
 									bracketConditions: currentAttempt.bracketConditions,
 									result:            result,
+									location:          currentAttempt.location,
 								},
 								tail:      attempts,
-								interrupt: tmp.(bool),
+								interrupt: tmp,
 							}
 
 							if interrupt == tmp || bracketCount > 0 {
@@ -1235,16 +2252,20 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 						// impossible to be killed.
 						if (interrupt != nil) && interrupt != tmp && bracketCount == 0 {
 							step = currentAttempt.bracketConditions["killed"].(func(Any) Any)(fromLeft(interrupt)).(func(Any) Any)(currentAttempt.result)
+							enterBracket(bracketStage("releasing (killed)", currentAttempt.location))
 						} else if fail != nil {
 							step = currentAttempt.bracketConditions["failed"].(func(Any) Any)(fromLeft(fail)).(func(Any) Any)(currentAttempt.result)
+							enterBracket(bracketStage("releasing (failed)", currentAttempt.location))
 						} else {
 							step = currentAttempt.bracketConditions["completed"].(func(Any) Any)(fromRight(step)).(func(Any) Any)(currentAttempt.result)
+							enterBracket(bracketStage("releasing (completed)", currentAttempt.location))
 						}
 						fail = nil
 						bracketCount++
 					case Finalizer:
 						// fmt.println("\tFinalizer")
 						bracketCount++
+						enterBracket("cancelling the effect it was killed in")
 						attempts = &InterruptCons{
 							head:      Finalized{step: step, fail: fail},
 							tail:      attempts,
@@ -1255,6 +2276,7 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 					case Finalized:
 						// fmt.println("\tFinalized")
 						bracketCount--
+						leaveBracket()
 						status = RETURN
 						step = currentAttempt.step
 						fail = currentAttempt.fail
@@ -1264,23 +2286,31 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 				}
 			case COMPLETED:
 				// fmt.println("COMPLETED", joins)
+				if live {
+					live = false
+					loop.add(-1, 0)
+				}
+				trace.done()
 				for _, join := range joins {
 					rethrow = rethrow && join.rethrow
 					join.handler(step)()
 				}
 				joins = nil
 				if (interrupt != nil) && fail != nil {
-				panic(fromLeft(fail))
+					panic(fromLeft(fail))
 				} else if isLeft(step).(bool) && rethrow {
-				panic(fromLeft(step))
+					panic(fromLeft(step))
 				}
 				return nil
 
 			case SUSPENDED:
 				// fmt.println("SUSPENDED")
 				status = CONTINUE
+				live = true
+				loop.add(1, 0)
 			case PENDING:
 				// fmt.Println("PENDING")
+				trace.pend("Async", bracketStages)
 				return nil
 
 			default:
@@ -1292,7 +2322,7 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 	runFn := func() Any {
 		if status == SUSPENDED {
 			// Just run directly - no need for scheduler in Go
-				run(runTick)
+			run(runTick)
 		}
 		return nil // Important to avoid panic
 	}
@@ -1351,7 +2381,7 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 			return canceler
 		}
 	}
-	
+
 	// Will be set to joinImpl or wrapped version depending on fork mode
 	var join func(Any) Any
 	kill := func(error Any, cbAny Any) Any {
@@ -1363,7 +2393,7 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 		return func() Any {
 			if status == COMPLETED {
 				// If the fiber is already completed, notify the callback
-				Run(Apply(cb, right(nil)))
+				Run(callbackEffect(cb, right(nil)))
 				return func() Any { return nil }
 			}
 
@@ -1372,7 +2402,7 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 				rethrow: false,
 				handler: func(result Any) func() Any {
 					return func() Any {
-						Run(Apply(cb, right(nil)))
+						Run(callbackEffect(cb, right(nil)))
 						return nil
 					}
 				},
@@ -1409,7 +2439,8 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 					status = RETURN
 					step = nil
 					fail = nil
-					run(runTick + 1)
+					runTick++
+					run(runTick)
 				}
 
 			default:
@@ -1430,7 +2461,13 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 	}
 	// Default: use the normal join implementation
 	join = joinImpl
-	
+
+	if trace != nil {
+		fiberDebug.mu.Lock()
+		trace.kill = kill
+		fiberDebug.mu.Unlock()
+	}
+
 	fiber := Dict{
 		"run":         runFn,
 		"kill":        kill,
@@ -1438,12 +2475,12 @@ func Fiber(util_ Any, supervisor Any, aff Any) Any {
 		"onComplete":  onComplete,
 		"isSuspended": func() Any { return status == SUSPENDED },
 	}
-	
+
 	return fiber
 }
 
 func init() {
-	exports := Foreign("Effect.Aff")
+	exports := exceptions.RegisterExports("Effect.Aff")
 
 	// ∷ ∀	 a b. Aff a → (a → Aff b) → Aff b
 	exports["_pure"] = func(value Any) Any {
@@ -1453,8 +2490,7 @@ func init() {
 	// ∷ ∀ a. Error → Aff a
 	exports["_throwError"] = func(e_ Any) Any {
 		// fmt.Println("func: _throwError")
-		e := e_.(error)
-		return Throw{err: e}
+		return Throw{err: exceptions.ToError(e_)}
 	}
 	// ∷ ∀ a. Aff a → (Error → Aff a) → Aff a
 	exports["_catchError"] = func(aff Any) Any {
@@ -1501,7 +2537,7 @@ func init() {
 	exports["_makeFiber"] = func(util Any, aff Any) Any {
 		// fmt.Println("func: _makeFiber")
 		return func() Any {
-			return Fiber(util, nil, aff)
+			return launched(Fiber(util, nil, aff))
 		}
 	}
 
@@ -1542,32 +2578,17 @@ func init() {
 			if cb == nil {
 				panic("_delay: callback is nil")
 			}
-			
-			// Capture these on the main thread before goroutine
-			cbCopy := cb
-			rightCopy := right
-			
-			// Start timer
-			timer := time.NewTimer(time.Duration(millis) * time.Millisecond)
-
-			// Spawn goroutine that waits then queues the callback invocation
-			go func() {
-				<-timer.C
-				// Queue an effect that will call the callback on the main thread
-				effectQueue <- func() Any {
-					// Now on main thread - safe to Apply and Run
-					result := rightCopy(nil)
-					effect := Apply(cbCopy, result)
-					return Run(effect.(func() Any))
-				}
-			}()
+
+			// The armed timer keeps the event loop alive until it fires or is stopped
+			stop := startTimer(time.Duration(millis)*time.Millisecond, func() {
+				ResumeAsync(cb, right(nil))
+			})
 
 			// Return canceler
 			return func() Canceler {
 				return func(error Any) Any {
 					return Sync{eff: func() Any {
-						stopped := timer.Stop()
-						return right(stopped)
+						return right(stop())
 					}}
 				}
 			}
@@ -1583,6 +2604,7 @@ func init() {
 					acquire:           acquire,
 					bracketConditions: bracketConditions,
 					withResource:      withResource,
+					location:          bracketLocation(),
 				}
 			}
 		}
@@ -1632,6 +2654,57 @@ func init() {
 		}
 	}
 
+	// setFiberDebug :: Boolean -> Effect Unit
+	// Tracks fibers created from now on, for dumpFibers
+	exports["setFiberDebug"] = func(on_ Any) Any {
+		return func() Any {
+			EnableFiberDebug(on_.(bool))
+			return nil
+		}
+	}
+
+	// dumpFibers :: Effect String
+	exports["dumpFibers"] = func() Any {
+		return DumpFibers()
+	}
+
+	// parTraverseN :: forall a b. Int -> (a -> Aff b) -> Array a -> Aff (Array b)
+	exports["parTraverseN"] = func(n_ Any, f Any, items_ Any) Any {
+		n := n_.(int)
+		items := items_.([]Any)
+		return MakeParTraverseN(n, func(item Any) Any { return Apply(f, item) }, items)
+	}
+
+	// parTraverseN_ :: forall a b. Int -> (a -> Aff b) -> Array a -> Aff Unit
+	exports["parTraverseN_"] = func(n_ Any, f Any, items_ Any) Any {
+		n := n_.(int)
+		items := items_.([]Any)
+		aff := MakeParTraverseN(n, func(item Any) Any { return Apply(f, item) }, items)
+		if t, ok := aff.(ParTraverseN); ok {
+			t.discard = true
+			return t
+		}
+		return aff
+	}
+
+	// timeout :: forall a. Milliseconds -> Aff a -> Aff (Maybe a)
+	exports["timeout"] = func(millis_ Any, aff Any) Any {
+		millis := millis_.(float64)
+		return Timeout(time.Duration(millis*float64(time.Millisecond)), aff)
+	}
+
+	// race :: forall a. Array (Aff a) -> Aff a
+	exports["race"] = func(affs_ Any) Any {
+		affs := affs_.([]Any)
+		return Race(affs)
+	}
+
+	// firstSuccess :: forall a. Array (Aff a) -> Aff a
+	exports["firstSuccess"] = func(affs_ Any) Any {
+		affs := affs_.([]Any)
+		return FirstSuccess(affs)
+	}
+
 	// ParAff ~> Aff
 	exports["_sequential"] = func(par Any) Any {
 		return Sequential{parAff: par}
@@ -1641,7 +2714,7 @@ func init() {
 	exports["_makeSupervisedFiber"] = func(util Any, aff Any) Any {
 		return func() Any {
 			supervisor := SupervisorNew(util)
-			fiber := Fiber(util, supervisor, aff)
+			fiber := launched(Fiber(util, supervisor, aff))
 			return Dict{
 				"fiber":      fiber,
 				"supervisor": supervisor,
@@ -1660,7 +2733,7 @@ func init() {
 	}
 
 	exports["nonCanceler"] = nonCanceler
-	
+
 	// Internal function to process queued effects from goroutines
 	exports["drainEffectQueueImpl"] = func() Any {
 		return func() Any {
@@ -0,0 +1,159 @@
+package purescript_aff
+
+import (
+	"sync"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+func init() {
+	exports := Foreign("Effect.Aff.AVar")
+
+	// empty :: forall a. Aff (AVar a)
+	exports["empty"] = MakeSync(func() Any {
+		return NewEmptyAVar()
+	})
+
+	// new :: forall a. a -> Aff (AVar a)
+	exports["new"] = func(value Any) Any {
+		return MakeSync(func() Any {
+			return NewAVar(value)
+		})
+	}
+
+	// take :: forall a. AVar a -> Aff a
+	exports["take"] = func(avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return TakeAVar(avar)
+	}
+
+	// put :: forall a. a -> AVar a -> Aff Unit
+	exports["put"] = func(value Any, avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return PutAVar(value, avar)
+	}
+
+	// read :: forall a. AVar a -> Aff a
+	exports["read"] = func(avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return ReadAVar(avar)
+	}
+
+	// tryTake :: forall a. AVar a -> Aff (Maybe a)
+	exports["tryTake"] = func(avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return MakeSync(func() Any {
+			if value, ok := avar.TryTake(); ok {
+				return Dict{"value0": value} // Just value
+			}
+			return Dict{} // Nothing
+		})
+	}
+
+	// tryPut :: forall a. a -> AVar a -> Aff Boolean
+	exports["tryPut"] = func(value Any, avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return MakeSync(func() Any {
+			return avar.TryPut(value)
+		})
+	}
+
+	// tryRead :: forall a. AVar a -> Aff (Maybe a)
+	exports["tryRead"] = func(avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return MakeSync(func() Any {
+			if value, ok := avar.TryRead(); ok {
+				return Dict{"value0": value} // Just value
+			}
+			return Dict{} // Nothing
+		})
+	}
+
+	// kill :: forall a. Error -> AVar a -> Aff Unit
+	exports["kill"] = func(err Any, avar_ Any) Any {
+		avar := avar_.(*AVar)
+		return MakeSync(func() Any {
+			avar.Kill(err)
+			return nil
+		})
+	}
+
+	// _status :: forall a. Fn2 FFIUtil (AVar a) (Aff (AVarStatus a))
+	// FFIUtil is the record passed to Effect.AVar's _status
+	exports["_status"] = func(util_ Any, avar_ Any) Any {
+		util := util_.(Dict)
+		avar := avar_.(*AVar)
+		return MakeSync(func() Any {
+			return avarStatus(util, avar)
+		})
+	}
+}
+
+// TakeAVar creates an Aff that waits for the AVar to be filled and empties
+// it. Killing the fiber while it waits removes it from the queue; killing it
+// after it was given a value, before it resumed, puts the value back.
+func TakeAVar(avar *AVar) GoAsync {
+	return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+		var given struct {
+			sync.Mutex
+			value Any
+			ok    bool
+		}
+		cancel := avar.Take(func(err Any, value Any) {
+			if err != nil {
+				onError(err)
+				return
+			}
+			given.Lock()
+			given.value, given.ok = value, true
+			given.Unlock()
+			onSuccess(value)
+		})
+		return avarCanceler(func() {
+			cancel()
+			given.Lock()
+			value, ok := given.value, given.ok
+			given.value, given.ok = nil, false
+			given.Unlock()
+			if ok {
+				avar.putBack(value)
+			}
+		})
+	})
+}
+
+// PutAVar creates an Aff that waits for the AVar to be empty and fills it
+func PutAVar(value Any, avar *AVar) GoAsync {
+	return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+		return avarCanceler(avar.Put(value, func(err Any) {
+			if err != nil {
+				onError(err)
+				return
+			}
+			onSuccess(nil)
+		}))
+	})
+}
+
+// ReadAVar creates an Aff that waits for the AVar to be filled and returns
+// its value, leaving it in place
+func ReadAVar(avar *AVar) GoAsync {
+	return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+		return avarCanceler(avar.Read(func(err Any, value Any) {
+			if err != nil {
+				onError(err)
+				return
+			}
+			onSuccess(value)
+		}))
+	})
+}
+
+func avarCanceler(cancel func()) Canceler {
+	return func(error Any) Any {
+		return MakeSync(func() Any {
+			cancel()
+			return nil
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package purescript_aff
+
+import (
+	"runtime"
+	"sync"
+
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
+	. "github.com/purescript-native/go-runtime"
+)
+
+func init() {
+	exports := exceptions.RegisterExports("Effect.Aff.Blocking")
+
+	// blocking :: forall a. Effect a -> Aff a
+	// Runs an effect that blocks (file or database access, reading a request
+	// body) on a worker goroutine, so other fibers keep running. A panic in
+	// the effect fails the Aff with the panic value.
+	exports["blocking"] = func(effect_ Any) Any {
+		effect := effect_.(func() Any)
+		return Blocking(effect)
+	}
+
+	// setPoolSize :: Int -> Effect Unit
+	// Sets how many blocking effects may run at once
+	exports["setPoolSize"] = func(size_ Any) Any {
+		return func() Any {
+			size := size_.(int)
+			SetBlockingPoolSize(size)
+			return nil
+		}
+	}
+
+	// poolStats :: Effect { size :: Int, active :: Int, queued :: Int }
+	exports["poolStats"] = func() Any {
+		size, active, queued := blockingPool.stats()
+		return Dict{"size": size, "active": active, "queued": queued}
+	}
+}
+
+// workerPool runs blocking effects on at most size worker goroutines,
+// which take jobs from a shared queue. Workers are started as jobs arrive
+// and stay idle until the pool shrinks.
+type workerPool struct {
+	mu      sync.Mutex
+	ready   *sync.Cond
+	size    int
+	workers int
+	active  int
+	jobs    []*blockingJob
+}
+
+type blockingJob struct {
+	run func()
+}
+
+var blockingPool = newWorkerPool(4 * runtime.NumCPU())
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{size: size}
+	p.ready = sync.NewCond(&p.mu)
+	return p
+}
+
+// submit queues a job for the next free worker
+func (p *workerPool) submit(job *blockingJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jobs = append(p.jobs, job)
+	if p.workers < p.size {
+		p.workers++
+		go p.work()
+		return
+	}
+	p.ready.Signal()
+}
+
+// cancel removes a job that no worker has taken yet, reporting whether it
+// was still queued
+func (p *workerPool) cancel(job *blockingJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, queued := range p.jobs {
+		if queued == job {
+			p.jobs = append(p.jobs[:i:i], p.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *workerPool) work() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for len(p.jobs) == 0 && p.workers <= p.size {
+			p.ready.Wait()
+		}
+		if p.workers > p.size {
+			p.workers--
+			return
+		}
+		job := p.jobs[0]
+		p.jobs[0] = nil
+		p.jobs = p.jobs[1:]
+		p.active++
+		p.mu.Unlock()
+		job.run()
+		p.mu.Lock()
+		p.active--
+	}
+}
+
+func (p *workerPool) resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = size
+	for p.workers < p.size && p.workers < p.active+len(p.jobs) {
+		p.workers++
+		go p.work()
+	}
+	p.ready.Broadcast()
+}
+
+// stats reports the pool size, how many jobs are running and how many are
+// waiting for a worker
+func (p *workerPool) stats() (size, active, queued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size, p.active, len(p.jobs)
+}
+
+// SetBlockingPoolSize sets how many blocking effects may run at once. It
+// must be at least 1; effects already running are not interrupted.
+func SetBlockingPoolSize(size int) {
+	if size < 1 {
+		panic(exceptions.Errorf("Blocking pool size must be at least 1, got %d", size))
+	}
+	blockingPool.resize(size)
+}
+
+// Blocking creates an Aff that runs effect on the worker pool. Killing the
+// fiber before the effect has started means it never runs.
+func Blocking(effect EffFn) GoAsync {
+	return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+		job := &blockingJob{run: func() {
+			value, err := runRecovered(effect)
+			if err != nil {
+				onError(err)
+				return
+			}
+			onSuccess(value)
+		}}
+		blockingPool.submit(job)
+		return func(error Any) Any {
+			return MakeSync(func() Any {
+				blockingPool.cancel(job)
+				return nil
+			})
+		}
+	})
+}
+
+// runRecovered runs an effect, returning the value it panics with as an
+// Effect.Exception Error
+func runRecovered(effect EffFn) (value Any, err Any) {
+	value, recovered := exceptions.Recover(effect)
+	if recovered != nil {
+		return nil, recovered
+	}
+	return value, nil
+}
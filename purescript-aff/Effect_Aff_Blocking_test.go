@@ -0,0 +1,139 @@
+package purescript_aff
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
+	. "github.com/purescript-native/go-runtime"
+)
+
+// launch runs an Aff with launchAff and returns its result once the event
+// loop is idle
+func launch(aff Any) Dict {
+	fiber := Run(Foreign("Effect.Aff")["_makeFiber"].(func(Any, Any) Any)(makeUtil(), aff)).(Dict)
+	var result Any
+	fiber["onComplete"].(func(OnComplete) func() Any)(OnComplete{handler: func(res Any) func() Any {
+		return func() Any {
+			result = res
+			return nil
+		}
+	}})()
+	Run(fiber["run"])
+	return result.(Dict)
+}
+
+func TestBlocking(t *testing.T) {
+	blocking := Foreign("Effect.Aff.Blocking")["blocking"].(func(Any) Any)
+
+	result := launch(blocking(func() Any { return 42 }))
+	if result["Right"] != 42 {
+		t.Errorf("Expected Right 42, got %v", result)
+	}
+
+	failure := errors.New("disk on fire")
+	result = launch(blocking(func() Any { panic(failure) }))
+	if err, ok := result["Left"].(*exceptions.Error); !ok || !errors.Is(err, failure) {
+		t.Errorf("Expected an Error caused by the panic, got %v", result)
+	}
+
+	result = launch(blocking(func() Any { panic("oops") }))
+	if err, ok := result["Left"].(*exceptions.Error); !ok || err.Message != "oops" {
+		t.Errorf("Expected an Error from the panic value, got %v", result)
+	}
+}
+
+func TestBlockingPoolSize(t *testing.T) {
+	exports := Foreign("Effect.Aff.Blocking")
+	blocking := exports["blocking"].(func(Any) Any)
+	setPoolSize := exports["setPoolSize"].(func(Any) Any)
+	size, _, _ := blockingPool.stats()
+	Run(setPoolSize(2))
+	defer SetBlockingPoolSize(size)
+
+	release := make(chan struct{})
+	finished := 0
+	for i := 0; i < 5; i++ {
+		fiber := Fiber(makeUtil(), nil, blocking(func() Any {
+			<-release
+			return nil
+		})).(Dict)
+		fiber["onComplete"].(func(OnComplete) func() Any)(OnComplete{handler: func(Any) func() Any {
+			return func() Any {
+				finished++
+				return nil
+			}
+		}})()
+		Run(fiber["run"])
+	}
+
+	deadline := time.Now().Add(time.Second)
+	var stats Dict
+	for time.Now().Before(deadline) {
+		stats = Run(exports["poolStats"]).(Dict)
+		if stats["queued"] == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats["size"] != 2 || stats["active"] != 2 || stats["queued"] != 3 {
+		t.Errorf("Expected 2 active and 3 queued effects, got %v", stats)
+	}
+	close(release)
+	RunEventLoop()
+	if finished != 5 {
+		t.Errorf("Expected 5 blocking effects to finish, got %d", finished)
+	}
+
+	if result := launch(blocking(func() Any { return "free" })); result["Right"] != "free" {
+		t.Errorf("Expected the pool to be free again, got %v", result)
+	}
+}
+
+func TestWorkerPoolCancelAndResize(t *testing.T) {
+	pool := newWorkerPool(1)
+	release := make(chan struct{})
+	ran := make(chan int, 3)
+	jobs := make([]*blockingJob, 3)
+	for i := range jobs {
+		i := i
+		jobs[i] = &blockingJob{run: func() {
+			<-release
+			ran <- i
+		}}
+		pool.submit(jobs[i])
+	}
+	waitForActive := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if _, active, _ := pool.stats(); active == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForActive(1)
+
+	if !pool.cancel(jobs[1]) {
+		t.Error("Expected a queued job to be cancelled")
+	}
+	if _, _, queued := pool.stats(); queued != 1 {
+		t.Errorf("Expected 1 queued job after cancelling, got %d", queued)
+	}
+
+	pool.resize(2)
+	waitForActive(2)
+	if _, active, queued := pool.stats(); active != 2 || queued != 0 {
+		t.Errorf("Expected growing the pool to start the queued job, got %d active and %d queued", active, queued)
+	}
+	if pool.cancel(jobs[0]) {
+		t.Error("Expected a running job not to be cancelled")
+	}
+
+	close(release)
+	seen := map[int]bool{<-ran: true, <-ran: true}
+	if !seen[0] || !seen[2] || seen[1] {
+		t.Errorf("Expected jobs 0 and 2 to run, got %v", seen)
+	}
+}
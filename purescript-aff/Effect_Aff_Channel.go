@@ -0,0 +1,341 @@
+package purescript_aff
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
+	. "github.com/purescript-native/go-runtime"
+)
+
+// ErrChannelClosed is the error a send fails with once the channel is closed
+var ErrChannelClosed = errors.New("send on closed channel")
+
+func init() {
+	exports := exceptions.RegisterExports("Effect.Aff.Channel")
+
+	// unbounded :: forall a. Effect (Channel a)
+	exports["unbounded"] = func() Any {
+		return NewChannel(0)
+	}
+
+	// bounded :: forall a. Int -> Effect (Channel a)
+	// Sends wait while the channel holds this many values
+	exports["bounded"] = func(capacity_ Any) Any {
+		return func() Any {
+			capacity := capacity_.(int)
+			if capacity < 1 {
+				panic(exceptions.Errorf("Channel capacity must be at least 1, got %d", capacity))
+			}
+			return NewChannel(capacity)
+		}
+	}
+
+	// send :: forall a. a -> Channel a -> Aff Unit
+	exports["send"] = func(value Any, channel_ Any) Any {
+		channel := channel_.(*Channel)
+		return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+			cancel := channel.send(value, func(err error) {
+				if err != nil {
+					onError(err)
+					return
+				}
+				onSuccess(nil)
+			})
+			return channelCanceler(cancel)
+		})
+	}
+
+	// receive :: forall a. Channel a -> Aff (Maybe a)
+	// Nothing once the channel is closed and empty
+	exports["receive"] = func(channel_ Any) Any {
+		channel := channel_.(*Channel)
+		return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+			cancel := channel.receive(new(int32), func(value Any, ok bool) {
+				onSuccess(maybeValue(value, ok))
+			})
+			return channelCanceler(cancel)
+		})
+	}
+
+	// tryReceive :: forall a. Channel a -> Effect (Maybe a)
+	exports["tryReceive"] = func(channel_ Any) Any {
+		return func() Any {
+			channel := channel_.(*Channel)
+			value, ok := channel.TryReceive()
+			return maybeValue(value, ok)
+		}
+	}
+
+	// close :: forall a. Channel a -> Effect Unit
+	// Waiting receivers get Nothing and waiting senders fail
+	exports["close"] = func(channel_ Any) Any {
+		return func() Any {
+			channel := channel_.(*Channel)
+			channel.Close()
+			return nil
+		}
+	}
+
+	// select :: forall a. Array (Channel a) -> Aff (Tuple Int (Maybe a))
+	// Receives from whichever channel is ready first, with its index.
+	// Exactly one value is taken; the other channels are left untouched
+	exports["select"] = func(channels_ Any) Any {
+		channels := channels_.([]Any)
+		return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+			claim := new(int32)
+			cancels := make([]func(), len(channels))
+			for i, channel := range channels {
+				index := i
+				cancels[i] = channel.(*Channel).receive(claim, func(value Any, ok bool) {
+					onSuccess(Dict{"value0": index, "value1": maybeValue(value, ok)})
+				})
+			}
+			return channelCanceler(func() {
+				for _, cancel := range cancels {
+					cancel()
+				}
+			})
+		})
+	}
+}
+
+func maybeValue(value Any, ok bool) Any {
+	if ok {
+		return Dict{"value0": value} // Just value
+	}
+	return Dict{} // Nothing
+}
+
+func channelCanceler(cancel func()) Canceler {
+	return func(error Any) Any {
+		return MakeSync(func() Any {
+			cancel()
+			return nil
+		})
+	}
+}
+
+// Channel is a FIFO queue between fibers and goroutines. A bounded channel
+// makes senders wait while it is full; an unbounded one never does.
+type Channel struct {
+	mu        sync.Mutex
+	capacity  int // 0 for unbounded
+	buffer    *list.List
+	closed    bool
+	senders   *list.List // of *channelSender
+	receivers *list.List // of *channelReceiver
+}
+
+type channelSender struct {
+	value Any
+	cb    func(err error)
+}
+
+// channelReceiver waits for a value. Receivers sharing a claim (see select)
+// take at most one value between them; deliver must not block.
+type channelReceiver struct {
+	claim   *int32
+	deliver func(value Any, ok bool)
+}
+
+// NewChannel creates a channel holding up to capacity values, or any number
+// of values if capacity is 0
+func NewChannel(capacity int) *Channel {
+	return &Channel{
+		capacity:  capacity,
+		buffer:    list.New(),
+		senders:   list.New(),
+		receivers: list.New(),
+	}
+}
+
+// handOver gives value to the first waiting receiver that can still take
+// it. It must be called with the lock held.
+func (c *Channel) handOver(value Any, ok bool) bool {
+	for e := c.receivers.Front(); e != nil; e = c.receivers.Front() {
+		r := c.receivers.Remove(e).(*channelReceiver)
+		if atomic.CompareAndSwapInt32(r.claim, 0, 1) {
+			r.deliver(value, ok)
+			return true
+		}
+	}
+	return false
+}
+
+// send queues a value, calling cb once it is in the channel. The returned
+// function withdraws a send that is still waiting.
+func (c *Channel) send(value Any, cb func(err error)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.closed:
+		cb(ErrChannelClosed)
+	case c.buffer.Len() == 0 && c.handOver(value, true):
+		cb(nil)
+	case c.capacity == 0 || c.buffer.Len() < c.capacity:
+		c.buffer.PushBack(value)
+		cb(nil)
+	default:
+		e := c.senders.PushBack(&channelSender{value: value, cb: cb})
+		return func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.senders.Remove(e)
+		}
+	}
+	return func() {}
+}
+
+// receive calls deliver with the next value, or with ok false once the
+// channel is closed and empty, unless claim has already been taken. The
+// returned function withdraws a receive that is still waiting, or puts a
+// value it was given back at the head of the channel: a fiber killed before
+// resuming with the value never saw it.
+func (c *Channel) receive(claim *int32, deliver func(value Any, ok bool)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// given is only touched with the lock held
+	var given *Any
+	record := func(value Any, ok bool) {
+		if ok {
+			given = &value
+		}
+		deliver(value, ok)
+	}
+	giveBack := func() {
+		if given != nil {
+			c.putBack(*given)
+			given = nil
+		}
+	}
+	if c.buffer.Len() > 0 || c.closed {
+		if atomic.CompareAndSwapInt32(claim, 0, 1) {
+			record(c.take())
+		}
+		return func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			giveBack()
+		}
+	}
+	// Drop receivers whose select was won by another channel
+	for e := c.receivers.Front(); e != nil; {
+		next := e.Next()
+		if atomic.LoadInt32(e.Value.(*channelReceiver).claim) != 0 {
+			c.receivers.Remove(e)
+		}
+		e = next
+	}
+	e := c.receivers.PushBack(&channelReceiver{claim: claim, deliver: record})
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.receivers.Remove(e)
+		giveBack()
+	}
+}
+
+// putBack returns a received value to the head of the channel, handing it
+// to the next waiting receiver if there is one. A bounded channel may hold
+// one value over its capacity until it is taken. It must be called with the
+// lock held.
+func (c *Channel) putBack(value Any) {
+	if c.buffer.Len() == 0 && c.handOver(value, true) {
+		return
+	}
+	c.buffer.PushFront(value)
+}
+
+// take removes the next value, letting a waiting sender in. It must be
+// called with the lock held.
+func (c *Channel) take() (Any, bool) {
+	if c.buffer.Len() == 0 {
+		return nil, false
+	}
+	value := c.buffer.Remove(c.buffer.Front())
+	if e := c.senders.Front(); e != nil {
+		s := c.senders.Remove(e).(*channelSender)
+		c.buffer.PushBack(s.value)
+		s.cb(nil)
+	}
+	return value, true
+}
+
+// TryReceive takes the next value if there is one
+func (c *Channel) TryReceive() (Any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.take()
+}
+
+// Close stops the channel accepting values. Values already sent can still
+// be received.
+func (c *Channel) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for e := c.senders.Front(); e != nil; e = c.senders.Front() {
+		c.senders.Remove(e).(*channelSender).cb(ErrChannelClosed)
+	}
+	for c.handOver(nil, false) {
+	}
+}
+
+// Send sends a value from a goroutine, waiting while the channel is full
+func (c *Channel) Send(value Any) error {
+	done := make(chan error, 1)
+	c.send(value, func(err error) { done <- err })
+	return <-done
+}
+
+// Receive waits for a value on a goroutine, with ok false once the channel
+// is closed and empty
+func (c *Channel) Receive() (value Any, ok bool) {
+	type result struct {
+		value Any
+		ok    bool
+	}
+	done := make(chan result, 1)
+	c.receive(new(int32), func(value Any, ok bool) { done <- result{value, ok} })
+	r := <-done
+	return r.value, r.ok
+}
+
+// FromGoChan creates a channel fed by a Go channel, so goroutines can hand
+// values to fibers. It is closed when ch is closed; capacity is as for
+// NewChannel.
+func FromGoChan(ch <-chan Any, capacity int) *Channel {
+	c := NewChannel(capacity)
+	go func() {
+		for value := range ch {
+			if c.Send(value) != nil {
+				return
+			}
+		}
+		c.Close()
+	}()
+	return c
+}
+
+// ToGoChan creates a Go channel that receives the values sent to c by
+// fibers. It is closed when c is closed.
+func ToGoChan(c *Channel) <-chan Any {
+	ch := make(chan Any)
+	go func() {
+		defer close(ch)
+		for {
+			value, ok := c.Receive()
+			if !ok {
+				return
+			}
+			ch <- value
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,136 @@
+package purescript_aff
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+// receiveAll receives from a channel until it is closed
+func receiveAll(channel Any, values *[]Any) Any {
+	receive := Foreign("Effect.Aff.Channel")["receive"].(func(Any) Any)
+	return MakeBind(receive(channel), func(result Any) Any {
+		value, ok := result.(Dict)["value0"]
+		if !ok {
+			return MakePure(nil)
+		}
+		*values = append(*values, value)
+		return receiveAll(channel, values)
+	})
+}
+
+func TestChannelFromGoChan(t *testing.T) {
+	ch := make(chan Any)
+	go func() {
+		for i := 0; i < 50; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+
+	var values []Any
+	launch(receiveAll(FromGoChan(ch, 4), &values))
+	if len(values) != 50 || values[0] != 0 || values[49] != 49 {
+		t.Errorf("Expected 0 to 49 in order, got %v", values)
+	}
+}
+
+func TestChannelToGoChan(t *testing.T) {
+	exports := Foreign("Effect.Aff.Channel")
+	send := exports["send"].(func(Any, Any) Any)
+	channel := Run(exports["bounded"].(func(Any) Any)(1)).(*Channel)
+	received := ToGoChan(channel)
+
+	// The bounded channel makes each send wait for the Go side
+	var sendAll func(i int) Any
+	sendAll = func(i int) Any {
+		if i == 10 {
+			return MakeSync(func() Any {
+				Run(exports["close"].(func(Any) Any)(channel))
+				return nil
+			})
+		}
+		return MakeBind(send(i, channel), func(Any) Any { return sendAll(i + 1) })
+	}
+	collected := make(chan []Any)
+	go func() {
+		var values []Any
+		for value := range received {
+			values = append(values, value)
+		}
+		collected <- values
+	}()
+	launch(sendAll(0))
+
+	values := <-collected
+	if len(values) != 10 || values[0] != 0 || values[9] != 9 {
+		t.Errorf("Expected 0 to 9 in order, got %v", values)
+	}
+	if result := launch(send(11, channel)); result["Left"] != ErrChannelClosed {
+		t.Errorf("Expected sending on a closed channel to fail, got %v", result)
+	}
+}
+
+func TestChannelSelect(t *testing.T) {
+	exports := Foreign("Effect.Aff.Channel")
+	sel := exports["select"].(func(Any) Any)
+	tryReceive := exports["tryReceive"].(func(Any) Any)
+	first := NewChannel(0)
+	second := NewChannel(0)
+
+	result := launch(MakeBind(MakeSync(func() Any {
+		go second.Send("b")
+		return nil
+	}), func(Any) Any {
+		return sel([]Any{first, second})
+	}))
+	tuple := result["Right"].(Dict)
+	if tuple["value0"] != 1 || tuple["value1"].(Dict)["value0"] != "b" {
+		t.Fatalf("Expected Tuple 1 (Just b), got %v", result)
+	}
+
+	// The losing channel keeps values sent afterwards
+	first.Send("a")
+	if value := Run(tryReceive(first)).(Dict); value["value0"] != "a" {
+		t.Errorf("Expected Just a from the first channel, got %v", value)
+	}
+	if value := Run(tryReceive(second)).(Dict); len(value) != 0 {
+		t.Errorf("Expected Nothing from the second channel, got %v", value)
+	}
+}
+
+func TestChannelReceiveKilledBeforeResume(t *testing.T) {
+	exports := Foreign("Effect.Aff.Channel")
+	receive := exports["receive"].(func(Any) Any)
+	channel := NewChannel(0)
+	channel.Send("first")
+	channel.Send("second")
+
+	// The value is handed over at once, but the fiber is killed before its
+	// resume runs on the event loop
+	fiber := Fiber(makeUtil(), nil, receive(channel)).(Dict)
+	Run(fiber["run"])
+	Run(fiber["kill"].(func(Any, Any) Any)(errors.New("stop"), func(Any) func() Any {
+		return func() Any { return nil }
+	}))
+	RunEventLoop()
+
+	first, _ := channel.TryReceive()
+	second, _ := channel.TryReceive()
+	if first != "first" || second != "second" {
+		t.Errorf("Expected the value to be put back in order, got %v and %v", first, second)
+	}
+
+	// A waiting receive handed a value by a send
+	fiber = Fiber(makeUtil(), nil, receive(channel)).(Dict)
+	Run(fiber["run"])
+	channel.Send("third")
+	Run(fiber["kill"].(func(Any, Any) Any)(errors.New("stop"), func(Any) func() Any {
+		return func() Any { return nil }
+	}))
+	RunEventLoop()
+	if value, ok := channel.TryReceive(); !ok || value != "third" {
+		t.Errorf("Expected the handed over value to be put back, got %v", value)
+	}
+}
@@ -0,0 +1,93 @@
+package purescript_aff
+
+import (
+	. "github.com/purescript-native/go-runtime"
+)
+
+func init() {
+	exports := Foreign("Effect.Aff.Local")
+
+	// newKey :: forall a. String -> Effect (Key a)
+	// The name is only for debugging; every key is distinct
+	exports["newKey"] = func(name_ Any) Any {
+		return func() Any {
+			name := name_.(string)
+			return NewLocalKey(name)
+		}
+	}
+
+	// withLocal :: forall a b. Key a -> a -> Aff b -> Aff b
+	exports["withLocal"] = func(key_ Any, value Any, aff Any) Any {
+		key := key_.(*LocalKey)
+		return WithLocal(key, value, aff)
+	}
+
+	// getLocal :: forall a. Key a -> Aff (Maybe a)
+	exports["getLocal"] = func(key_ Any) Any {
+		key := key_.(*LocalKey)
+		return ReadLocal(key, func(value Any, ok bool) Any {
+			if ok {
+				return MakePure(Dict{"value0": value}) // Just value
+			}
+			return MakePure(Dict{}) // Nothing
+		})
+	}
+}
+
+// LocalKey identifies a fiber-local value
+type LocalKey struct {
+	name string
+}
+
+// NewLocalKey creates a key, distinct from every other key
+func NewLocalKey(name string) *LocalKey {
+	return &LocalKey{name: name}
+}
+
+func (k *LocalKey) String() string {
+	return k.name
+}
+
+// localFrame is one binding in a fiber's locals. Frames are never changed,
+// so fibers started with them can share them.
+type localFrame struct {
+	key   *LocalKey
+	value Any
+	next  *localFrame
+}
+
+func (f *localFrame) lookup(key *LocalKey) (Any, bool) {
+	for ; f != nil; f = f.next {
+		if f.key == key {
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+// WithLocal runs aff with key bound to value. Fibers it forks, and the
+// branches of parallel Affs it runs, see the binding too.
+func WithLocal(key *LocalKey, value Any, aff Any) Any {
+	bind := Locals{update: func(f *localFrame) *localFrame {
+		return &localFrame{key: key, value: value, next: f}
+	}}
+	return MakeBind(bind, func(previous Any) Any {
+		restore := Locals{update: func(*localFrame) *localFrame {
+			return previous.(*localFrame)
+		}}
+		return MakeBind(MakeCatch(aff, func(err Any) Any {
+			return MakeBind(restore, func(Any) Any { return MakeThrow(err) })
+		}), func(result Any) Any {
+			return MakeBind(restore, func(Any) Any { return MakePure(result) })
+		})
+	})
+}
+
+// ReadLocal creates an Aff that continues with k and the value bound to key
+// in the running fiber, if there is one
+func ReadLocal(key *LocalKey, k func(value Any, ok bool) Any) Any {
+	read := Locals{update: func(f *localFrame) *localFrame { return f }}
+	return MakeBind(read, func(frame Any) Any {
+		return k(frame.(*localFrame).lookup(key))
+	})
+}
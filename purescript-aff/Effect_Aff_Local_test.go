@@ -0,0 +1,102 @@
+package purescript_aff
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+// localValue reads key, as a value or "none"
+func localValue(key *LocalKey) Any {
+	return ReadLocal(key, func(value Any, ok bool) Any {
+		if !ok {
+			return MakePure("none")
+		}
+		return MakePure(value)
+	})
+}
+
+func TestLocal(t *testing.T) {
+	exports := Foreign("Effect.Aff.Local")
+	withLocal := exports["withLocal"].(func(Any, Any, Any) Any)
+	getLocal := exports["getLocal"].(func(Any) Any)
+	key := Run(exports["newKey"].(func(Any) Any)("user")).(*LocalKey)
+
+	var seen []Any
+	record := func(aff Any) Any {
+		return MakeBind(aff, func(value Any) Any {
+			seen = append(seen, value)
+			return MakePure(nil)
+		})
+	}
+	then := func(first Any, second Any) Any {
+		return MakeBind(first, func(Any) Any { return second })
+	}
+
+	// Bindings shadow outer ones and are undone afterwards, even on failure
+	failure := errors.New("boom")
+	launch(then(
+		withLocal(key, "outer", then(
+			withLocal(key, "inner", record(localValue(key))),
+			then(
+				MakeCatch(withLocal(key, "failed", MakeThrow(failure)), func(Any) Any { return MakePure(nil) }),
+				record(localValue(key))))),
+		record(localValue(key))))
+	expected := []Any{"inner", "outer", "none"}
+	for i, value := range expected {
+		if i >= len(seen) || seen[i] != value {
+			t.Fatalf("Expected %v, got %v", expected, seen)
+		}
+	}
+
+	result := launch(withLocal(key, "alice", getLocal(key)))
+	if value := result["Right"].(Dict); value["value0"] != "alice" {
+		t.Errorf("Expected Just alice, got %v", result)
+	}
+	if result := launch(getLocal(NewLocalKey("unbound"))); len(result["Right"].(Dict)) != 0 {
+		t.Errorf("Expected Nothing, got %v", result)
+	}
+}
+
+func TestLocalInherited(t *testing.T) {
+	exports := Foreign("Effect.Aff")
+	fork := exports["_fork"].(func(Any) Any)
+	parMap := exports["_parAffMap"].(func(Any) Any)
+	parApply := exports["_parAffApply"].(func(Any) Any)
+	join := func(fiber Any) Any {
+		return Async{asyncFn: func(cb Any) Any {
+			return fiber.(Dict)["join"].(func(Any) Any)(cb)
+		}}
+	}
+
+	tenant := NewLocalKey("tenant")
+	requestID := NewLocalKey("requestId")
+
+	// A forked fiber sees the binding, even after the parent leaves it
+	forked := WithLocal(tenant, "acme", Apply(fork(true), localValue(tenant)))
+	result := launch(MakeBind(forked, join))
+	if result["Right"] != "acme" {
+		t.Errorf("Expected the fork to see acme, got %v", result)
+	}
+
+	// Both branches of a parallel apply see it
+	pair := func(a Any) Any {
+		return func(b Any) Any { return []Any{a, b} }
+	}
+	par := Apply(parApply(Apply(parMap(pair), localValue(requestID))), localValue(requestID))
+	result = launch(WithLocal(requestID, "req-1", Sequential{parAff: par}))
+	values := result["Right"].([]Any)
+	if values[0] != "req-1" || values[1] != "req-1" {
+		t.Errorf("Expected both branches to see req-1, got %v", values)
+	}
+
+	traversed := launch(WithLocal(requestID, "req-2", MakeParTraverseN(2, func(Any) Any {
+		return localValue(requestID)
+	}, []Any{1, 2, 3})))
+	for _, value := range traversed["Right"].([]Any) {
+		if value != "req-2" {
+			t.Errorf("Expected every item to see req-2, got %v", traversed)
+		}
+	}
+}
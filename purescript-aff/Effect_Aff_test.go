@@ -1,10 +1,19 @@
 package purescript_aff
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
 	. "github.com/purescript-native/go-runtime"
 )
 
@@ -43,20 +52,36 @@ func makeUtil() Dict {
 	}
 }
 
+// awaitDone runs queued effects, as the event loop would, until done
+// receives or timeout passes
+func awaitDone(done chan bool, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		DrainEffectQueue()
+		select {
+		case <-done:
+			return true
+		case <-deadline:
+			return false
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
 func TestPureAff(t *testing.T) {
 	util := makeUtil()
-	
+
 	// Create a Pure Aff
 	aff := Pure{value: 42}
-	
+
 	// Create a fiber
 	fiber := Fiber(util, nil, aff)
 	fiberDict := fiber.(Dict)
-	
+
 	// Track completion
 	completed := false
 	var result Any
-	
+
 	// Register completion handler
 	onComplete := fiberDict["onComplete"].(func(OnComplete) func() Any)
 	onComplete(OnComplete{
@@ -69,32 +94,32 @@ func TestPureAff(t *testing.T) {
 			}
 		},
 	})()
-	
+
 	// Run the fiber
 	runFn := fiberDict["run"].(func() Any)
 	runFn()
-	
+
 	// Check result
 	if !completed {
 		t.Fatal("Fiber did not complete")
 	}
-	
+
 	// Result should be Right 42
 	resultDict := result.(Dict)
 	if _, hasRight := resultDict["Right"]; !hasRight {
 		t.Fatal("Result should be Right")
 	}
-	
+
 	if resultDict["Right"] != 42 {
 		t.Fatalf("Expected 42, got %v", resultDict["Right"])
 	}
-	
+
 	t.Log("✓ Pure Aff works correctly")
 }
 
 func TestBindAff(t *testing.T) {
 	util := makeUtil()
-	
+
 	// Create Pure(10) >>= (\x -> Pure(x * 2))
 	aff1 := Pure{value: 10}
 	aff2 := Bind{
@@ -103,14 +128,14 @@ func TestBindAff(t *testing.T) {
 			return Pure{value: x.(int) * 2}
 		},
 	}
-	
+
 	// Create a fiber
 	fiber := Fiber(util, nil, aff2)
 	fiberDict := fiber.(Dict)
-	
+
 	completed := false
 	var result Any
-	
+
 	onComplete := fiberDict["onComplete"].(func(OnComplete) func() Any)
 	onComplete(OnComplete{
 		rethrow: false,
@@ -122,26 +147,26 @@ func TestBindAff(t *testing.T) {
 			}
 		},
 	})()
-	
+
 	runFn := fiberDict["run"].(func() Any)
 	runFn()
-	
+
 	if !completed {
 		t.Fatal("Fiber did not complete")
 	}
-	
+
 	resultDict := result.(Dict)
 	if resultDict["Right"] != 20 {
 		t.Fatalf("Expected 20, got %v", resultDict["Right"])
 	}
-	
+
 	t.Log("✓ Bind Aff works correctly")
 }
 
 func TestAsyncAff(t *testing.T) {
 	util := makeUtil()
 	right := util["right"].(func(Any) Any)
-	
+
 	// Create an async Aff that completes after a short delay
 	aff := Async{
 		asyncFn: func(cb Any) Any {
@@ -153,7 +178,7 @@ func TestAsyncAff(t *testing.T) {
 					effect := cb.(func(Any) func() Any)(right(123))
 					effect()
 				}()
-				
+
 				// Return canceler
 				return func(error Any) Any {
 					return Pure{value: Dict{}}
@@ -161,14 +186,14 @@ func TestAsyncAff(t *testing.T) {
 			}
 		},
 	}
-	
+
 	fiber := Fiber(util, nil, aff)
 	fiberDict := fiber.(Dict)
-	
+
 	completed := false
 	var result Any
-	done := make(chan bool)
-	
+	done := make(chan bool, 1)
+
 	onComplete := fiberDict["onComplete"].(func(OnComplete) func() Any)
 	onComplete(OnComplete{
 		rethrow: false,
@@ -181,33 +206,30 @@ func TestAsyncAff(t *testing.T) {
 			}
 		},
 	})()
-	
+
 	runFn := fiberDict["run"].(func() Any)
 	runFn()
-	
-	// Wait for completion with timeout
-	select {
-	case <-done:
-		// Success
-	case <-time.After(1 * time.Second):
+
+	// The callback resumes the fiber on the event loop
+	if !awaitDone(done, time.Second) {
 		t.Fatal("Async Aff timed out")
 	}
-	
+
 	if !completed {
 		t.Fatal("Fiber did not complete")
 	}
-	
+
 	resultDict := result.(Dict)
 	if resultDict["Right"] != 123 {
 		t.Fatalf("Expected 123, got %v", resultDict["Right"])
 	}
-	
+
 	t.Log("✓ Async Aff works correctly")
 }
 
 func TestCatchError(t *testing.T) {
 	util := makeUtil()
-	
+
 	// Create Throw >>= Catch
 	throwAff := Throw{err: fmt.Errorf("test error")}
 	catchAff := Catch{
@@ -216,13 +238,13 @@ func TestCatchError(t *testing.T) {
 			return Pure{value: "caught"}
 		},
 	}
-	
+
 	fiber := Fiber(util, nil, catchAff)
 	fiberDict := fiber.(Dict)
-	
+
 	completed := false
 	var result Any
-	
+
 	onComplete := fiberDict["onComplete"].(func(OnComplete) func() Any)
 	onComplete(OnComplete{
 		rethrow: false,
@@ -234,43 +256,43 @@ func TestCatchError(t *testing.T) {
 			}
 		},
 	})()
-	
+
 	runFn := fiberDict["run"].(func() Any)
 	runFn()
-	
+
 	if !completed {
 		t.Fatal("Fiber did not complete")
 	}
-	
+
 	resultDict := result.(Dict)
 	if resultDict["Right"] != "caught" {
 		t.Fatalf("Expected 'caught', got %v", resultDict["Right"])
 	}
-	
+
 	t.Log("✓ Catch Error works correctly")
 }
 
 func TestParallelMap(t *testing.T) {
-	
+
 	util := makeUtil()
-	
+
 	// Create ParMap that doubles a value
 	parAff := ParMap{
 		bToA:      func(x Any) Any { return x.(int) * 2 },
 		parAffOfB: Pure{value: 21},
 		result:    EMPTY,
 	}
-	
+
 	// Convert to sequential Aff
 	seqAff := Sequential{parAff: parAff}
-	
+
 	fiber := Fiber(util, nil, seqAff)
 	fiberDict := fiber.(Dict)
-	
+
 	completed := false
 	var result Any
 	done := make(chan bool, 1)
-	
+
 	onComplete := fiberDict["onComplete"].(func(OnComplete) func() Any)
 	onComplete(OnComplete{
 		rethrow: false,
@@ -286,86 +308,730 @@ func TestParallelMap(t *testing.T) {
 			}
 		},
 	})()
-	
+
 	runFn := fiberDict["run"].(func() Any)
 	runFn()
-	
+
 	// Wait for completion
-	select {
-	case <-done:
-		// Success
-	case <-time.After(100 * time.Millisecond):
+	if !awaitDone(done, 100*time.Millisecond) {
 		t.Fatal("Parallel Map timed out - likely deadlock in runPar")
 	}
-	
+
 	if !completed {
 		t.Fatal("Fiber did not complete")
 	}
-	
+
 	resultDict := result.(Dict)
 	if resultDict["Right"] != 42 {
 		t.Fatalf("Expected 42, got %v", resultDict["Right"])
 	}
-	
+
 	t.Log("✓ Parallel Map works correctly")
 }
 
 func TestSupervisor(t *testing.T) {
-	
+
 	util := makeUtil()
-	
+
 	supervisor := SupervisorNew(util)
 	supervisorDict := supervisor.(Dict)
-	
+
 	// Check isEmpty
 	isEmpty := supervisorDict["isEmpty"].(func() Any)()
 	if !isEmpty.(bool) {
 		t.Fatal("New supervisor should be empty")
 	}
-	
+
 	// Register a fiber
 	fiber := Fiber(util, supervisor, Pure{value: 1})
 	registerFn := supervisorDict["register"].(func(Any))
 	registerFn(fiber)
-	
+
 	// Should not be empty now
 	isEmpty = supervisorDict["isEmpty"].(func() Any)()
 	if isEmpty.(bool) {
 		t.Fatal("Supervisor should not be empty after registration")
 	}
-	
+
 	// Run the fiber to completion
 	fiberDict := fiber.(Dict)
 	runFn := fiberDict["run"].(func() Any)
 	runFn()
-	
+
 	// Give it a moment to complete
 	time.Sleep(10 * time.Millisecond)
-	
+
 	// Should be empty again
 	isEmpty = supervisorDict["isEmpty"].(func() Any)()
 	if !isEmpty.(bool) {
 		t.Fatal("Supervisor should be empty after fiber completes")
 	}
-	
+
 	t.Log("✓ Supervisor works correctly")
 }
 
 func TestEffectQueue(t *testing.T) {
 	// Test the effect queue mechanism
 	executed := false
-	
+
 	QueueEffect(func() Any {
 		executed = true
 		return nil
 	})
-	
+
 	DrainEffectQueue()
-	
+
 	if !executed {
 		t.Fatal("Effect was not executed")
 	}
-	
+
 	t.Log("✓ Effect queue works correctly")
 }
 
+func TestGoAsyncDelay(t *testing.T) {
+	util := makeUtil()
+
+	// Delay then map the plain value delivered by a GoAsync
+	aff := MakeBind(Delay(5*time.Millisecond), func(Any) Any {
+		return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+			go onSuccess(7)
+			return nonCanceler
+		})
+	})
+
+	fiber := Fiber(util, nil, aff)
+	fiberDict := fiber.(Dict)
+
+	var result Any
+	onComplete := fiberDict["onComplete"].(func(OnComplete) func() Any)
+	onComplete(OnComplete{
+		rethrow: false,
+		handler: func(res Any) func() Any {
+			return func() Any {
+				result = res
+				return nil
+			}
+		},
+	})()
+
+	fiberDict["run"].(func() Any)()
+
+	deadline := time.Now().Add(time.Second)
+	for result == nil && time.Now().Before(deadline) {
+		DrainEffectQueue()
+		time.Sleep(time.Millisecond)
+	}
+
+	if result == nil {
+		t.Fatal("GoAsync did not resume the fiber")
+	}
+	if result.(Dict)["Right"] != 7 {
+		t.Fatalf("Expected Right 7, got %v", result)
+	}
+
+	t.Log("✓ GoAsync and Delay work correctly")
+}
+
+func TestLaunchAffRunsEventLoop(t *testing.T) {
+	exports := Foreign("Effect.Aff")
+	delay := exports["_delay"].(func(Any, Any) Any)
+	right := makeUtil()["right"].(func(Any) Any)
+
+	// Two timers and an async effect, with nobody draining the queue
+	aff := MakeBind(delay(right, 5.0), func(Any) Any {
+		return MakeBind(Delay(5*time.Millisecond), func(Any) Any {
+			return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+				go onSuccess("done")
+				return nonCanceler
+			})
+		})
+	})
+
+	fiber := Run(exports["_makeFiber"].(func(Any, Any) Any)(makeUtil(), aff)).(Dict)
+	var result Any
+	onComplete := fiber["onComplete"].(func(OnComplete) func() Any)
+	onComplete(OnComplete{handler: func(res Any) func() Any {
+		return func() Any {
+			result = res
+			return nil
+		}
+	}})()
+
+	// Running the launched fiber returns once its work is done
+	Run(fiber["run"])
+	if result == nil || result.(Dict)["Right"] != "done" {
+		t.Fatalf("Expected Right done, got %v", result)
+	}
+}
+
+func TestEffectQueueUnbounded(t *testing.T) {
+	const count = 1000
+	executed := 0
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < count; i++ {
+			QueueEffect(func() Any {
+				executed++
+				return nil
+			})
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Queueing effects blocked")
+	}
+	DrainEffectQueue()
+	if executed != count {
+		t.Fatalf("Expected %d effects, got %d", count, executed)
+	}
+}
+
+// cancellable creates an Aff that succeeds with value after d, running on
+// its own goroutine. cancelled is closed if it is killed first.
+func cancellable(d time.Duration, value Any, cancelled chan struct{}) Any {
+	return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-time.After(d):
+				onSuccess(value)
+			case <-stop:
+			}
+		}()
+		return func(error Any) Any {
+			return MakeSync(func() Any {
+				close(stop)
+				close(cancelled)
+				return nil
+			})
+		}
+	})
+}
+
+func failing(d time.Duration, err error) Any {
+	return MakeBind(Delay(d), func(Any) Any { return MakeThrow(err) })
+}
+
+// checkNoLeaks waits for goroutines started by a test to finish
+func checkNoLeaks(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected %d goroutines, got %d", before, n)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	exports := Foreign("Effect.Aff")
+	timeout := exports["timeout"].(func(Any, Any) Any)
+	before := runtime.NumGoroutine()
+
+	cancelled := make(chan struct{})
+	result := launch(timeout(10.0, cancellable(time.Minute, "slow", cancelled)))
+	if value := result["Right"].(Dict); len(value) != 0 {
+		t.Errorf("Expected Nothing, got %v", result)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("Expected the timed out Aff to be cancelled")
+	}
+
+	// The timer is stopped when the Aff finishes first, so launch returns
+	// without waiting for it
+	start := time.Now()
+	result = launch(timeout(60000.0, cancellable(time.Millisecond, "fast", make(chan struct{}))))
+	if value := result["Right"].(Dict); value["value0"] != "fast" {
+		t.Errorf("Expected Just fast, got %v", result)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the timer to be cancelled, waited %v", elapsed)
+	}
+
+	failure := errors.New("boom")
+	if result := launch(timeout(60000.0, failing(time.Millisecond, failure))); result["Left"] != failure {
+		t.Errorf("Expected the failure to propagate, got %v", result)
+	}
+	checkNoLeaks(t, before)
+}
+
+func TestRace(t *testing.T) {
+	race := Foreign("Effect.Aff")["race"].(func(Any) Any)
+	before := runtime.NumGoroutine()
+
+	cancelled := make(chan struct{})
+	result := launch(race([]Any{
+		cancellable(time.Minute, "slow", cancelled),
+		cancellable(time.Millisecond, "fast", make(chan struct{})),
+	}))
+	if result["Right"] != "fast" {
+		t.Errorf("Expected Right fast, got %v", result)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("Expected the losing branch to be cancelled")
+	}
+
+	// A failure finishes the race too
+	failure := errors.New("first")
+	cancelled = make(chan struct{})
+	result = launch(race([]Any{failing(time.Millisecond, failure), cancellable(time.Minute, "slow", cancelled)}))
+	if result["Left"] != failure {
+		t.Errorf("Expected Left first, got %v", result)
+	}
+	<-cancelled
+	checkNoLeaks(t, before)
+}
+
+func TestFirstSuccess(t *testing.T) {
+	firstSuccess := Foreign("Effect.Aff")["firstSuccess"].(func(Any) Any)
+	before := runtime.NumGoroutine()
+
+	cancelled := make(chan struct{})
+	result := launch(firstSuccess([]Any{
+		failing(time.Millisecond, errors.New("fails")),
+		cancellable(20*time.Millisecond, "second", make(chan struct{})),
+		cancellable(time.Minute, "third", cancelled),
+	}))
+	if result["Right"] != "second" {
+		t.Errorf("Expected Right second, got %v", result)
+	}
+	<-cancelled
+
+	failure := errors.New("all failed")
+	result = launch(firstSuccess([]Any{failing(time.Millisecond, failure), failing(2*time.Millisecond, failure)}))
+	if result["Left"] != failure {
+		t.Errorf("Expected Left, got %v", result)
+	}
+	checkNoLeaks(t, before)
+}
+
+func TestParTraverseN(t *testing.T) {
+	parTraverseN := Foreign("Effect.Aff")["parTraverseN"].(func(Any, Any, Any) Any)
+
+	// Later items finish first, but results keep the order of the items
+	var mu sync.Mutex
+	active, peak := 0, 0
+	items := []Any{0, 1, 2, 3, 4, 5, 6, 7}
+	result := launch(parTraverseN(3, func(item Any) Any {
+		i := item.(int)
+		return MakeBind(MakeSync(func() Any {
+			mu.Lock()
+			active++
+			if active > peak {
+				peak = active
+			}
+			mu.Unlock()
+			return nil
+		}), func(Any) Any {
+			return MakeBind(Delay(time.Duration(8-i)*time.Millisecond), func(Any) Any {
+				mu.Lock()
+				active--
+				mu.Unlock()
+				return MakePure(i * 10)
+			})
+		})
+	}, items))
+	values := result["Right"].([]Any)
+	for i, value := range values {
+		if value != i*10 {
+			t.Fatalf("Expected results in order, got %v", values)
+		}
+	}
+	if peak != 3 {
+		t.Errorf("Expected at most 3 running at once, peaked at %d", peak)
+	}
+
+	if result := launch(parTraverseN(2, func(item Any) Any { return MakePure(item) }, []Any{})); len(result["Right"].([]Any)) != 0 {
+		t.Errorf("Expected an empty array, got %v", result)
+	}
+	if result := launch(parTraverseN(0, func(item Any) Any { return MakePure(item) }, items)); result["Left"] == nil {
+		t.Errorf("Expected a limit of 0 to fail, got %v", result)
+	}
+}
+
+func TestParTraverseNFailure(t *testing.T) {
+	parTraverseN_ := Foreign("Effect.Aff")["parTraverseN_"].(func(Any, Any, Any) Any)
+	before := runtime.NumGoroutine()
+
+	failure := errors.New("boom")
+	cancelled := make(chan struct{})
+	started := 0
+	result := launch(parTraverseN_(2, func(item Any) Any {
+		started++
+		if item == "fail" {
+			return failing(time.Millisecond, failure)
+		}
+		return cancellable(time.Minute, item, cancelled)
+	}, []Any{"slow", "fail", "never"}))
+	if result["Left"] != failure {
+		t.Errorf("Expected Left boom, got %v", result)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("Expected the running sibling to be cancelled")
+	}
+	if started != 2 {
+		t.Errorf("Expected the last item not to start, started %d", started)
+	}
+	checkNoLeaks(t, before)
+}
+
+// leaves creates items that each finish on their own goroutine
+func leaves(count int) []Any {
+	items := make([]Any, count)
+	for i := range items {
+		items[i] = i
+	}
+	return items
+}
+
+func leaf(item Any) Any {
+	return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+		go onSuccess(item)
+		return nonCanceler
+	})
+}
+
+func BenchmarkParTraverseN(b *testing.B) {
+	parTraverseN := Foreign("Effect.Aff")["parTraverseN"].(func(Any, Any, Any) Any)
+	items := leaves(1000)
+	for i := 0; i < b.N; i++ {
+		launch(parTraverseN(len(items), leaf, items))
+	}
+}
+
+// BenchmarkParApplyTree traverses the same items as an unbounded ParApply
+// tree, the way parTraverse builds it
+func BenchmarkParApplyTree(b *testing.B) {
+	exports := Foreign("Effect.Aff")
+	parMap := exports["_parAffMap"].(func(Any) Any)
+	parApply := exports["_parAffApply"].(func(Any) Any)
+	snoc := func(acc Any) Any {
+		return func(value Any) Any { return append(acc.([]Any), value) }
+	}
+	items := leaves(1000)
+	for i := 0; i < b.N; i++ {
+		var tree Any = MakePure([]Any{})
+		for _, item := range items {
+			tree = Apply(parApply(Apply(parMap(snoc), tree)), leaf(item))
+		}
+		launch(Sequential{parAff: tree})
+	}
+}
+
+func TestAffFromContextFunc(t *testing.T) {
+	result := launch(AffFromContextFunc(func(ctx context.Context) (Any, error) {
+		return "done", nil
+	}))
+	if result["Right"] != "done" {
+		t.Errorf("Expected Right done, got %v", result)
+	}
+
+	// Killing the fiber cancels the context
+	cancelled := make(chan struct{})
+	fiber := Fiber(makeUtil(), nil, AffFromContextFunc(func(ctx context.Context) (Any, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})).(Dict)
+	Run(fiber["run"])
+	Run(fiber["kill"].(func(Any, Any) Any)(errors.New("stop"), func(Any) func() Any {
+		return func() Any { return nil }
+	}))
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the context to be cancelled")
+	}
+}
+
+func TestRunAffWithContext(t *testing.T) {
+	value, err := RunAffWithContext(context.Background(), MakeBind(Delay(time.Millisecond), func(Any) Any {
+		return MakePure(42)
+	}))
+	if err != nil || value != 42 {
+		t.Errorf("Expected 42, got %v, %v", value, err)
+	}
+
+	failure := errors.New("boom")
+	if _, err := RunAffWithContext(context.Background(), MakeThrow(failure)); err != failure {
+		t.Errorf("Expected the failure, got %v", err)
+	}
+
+	// Cancelling the context kills the fiber
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cancelled := make(chan struct{})
+	if _, err := RunAffWithContext(ctx, cancellable(time.Minute, "slow", cancelled)); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+	<-cancelled
+}
+
+// Fibers run from many goroutines share the event loop (checked with
+// go test -race)
+func TestRunAffWithContextConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, err := RunAffWithContext(context.Background(), MakeBind(Delay(time.Duration(i%5)*time.Millisecond), func(Any) Any {
+				return MakePure(i)
+			}))
+			if err == nil && value != i {
+				err = fmt.Errorf("expected %d, got %v", i, value)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestFiberDebug(t *testing.T) {
+	exports := Foreign("Effect.Aff")
+	fork := exports["_fork"].(func(Any) Any)
+	Run(exports["setFiberDebug"].(func(Any) Any)(true))
+	defer EnableFiberDebug(false)
+
+	// The parent forks a child and both wait on async effects
+	resume := make(chan struct{})
+	waiting := func(value Any) Any {
+		return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+			go func() {
+				<-resume
+				onSuccess(value)
+			}()
+			return nonCanceler
+		})
+	}
+	parent := MakeBind(Apply(fork(true), waiting("child")), func(Any) Any {
+		return waiting("parent")
+	})
+	fiber := Fiber(makeUtil(), nil, parent).(Dict)
+	Run(fiber["run"])
+
+	infos := FiberSnapshot()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 fibers, got %v", infos)
+	}
+	if infos[1].Parent != infos[0].ID {
+		t.Errorf("Expected fiber %d to be the parent of %d, got %v", infos[0].ID, infos[1].ID, infos)
+	}
+	for _, info := range infos {
+		if info.Status != "PENDING" || info.WaitingOn != "GoAsync" {
+			t.Errorf("Expected a fiber pending on GoAsync, got %+v", info)
+		}
+	}
+	dump := Run(exports["dumpFibers"]).(string)
+	if !strings.HasPrefix(dump, "2 fibers\n") || !strings.Contains(dump, "\n  fiber") {
+		t.Errorf("Expected the child indented under its parent, got %q", dump)
+	}
+
+	// Completed fibers are dropped
+	close(resume)
+	RunEventLoop()
+	if infos := FiberSnapshot(); len(infos) != 0 {
+		t.Errorf("Expected no fibers, got %v", infos)
+	}
+}
+
+// A fiber stuck in a bracket is reported with the bracket's stage and the
+// code that created it
+func TestFiberDebugBrackets(t *testing.T) {
+	EnableFiberDebug(true)
+	defer EnableFiberDebug(false)
+	generalBracket := Foreign("Effect.Aff")["generalBracket"].(func(Any) Any)
+
+	acquired := make(chan struct{})
+	released := make(chan struct{})
+	waitFor := func(ch chan struct{}) Any {
+		return MakeGoAsync(func(onError func(Any), onSuccess func(Any)) Canceler {
+			go func() {
+				<-ch
+				onSuccess(nil)
+			}()
+			return nonCanceler
+		})
+	}
+	release := func(Any) Any {
+		return func(Any) Any { return waitFor(released) }
+	}
+	conditions := Dict{"killed": release, "failed": release, "completed": release}
+	bracket := generalBracket(waitFor(acquired)).(func(Any) Any)(conditions).(func(Any) Any)(func(Any) Any {
+		return MakePure(nil)
+	})
+	fiber := Fiber(makeUtil(), nil, bracket).(Dict)
+	Run(fiber["run"])
+
+	stages := func() []string {
+		infos := FiberSnapshot()
+		if len(infos) != 1 || infos[0].Brackets != len(infos[0].BracketStages) {
+			t.Fatalf("Expected one fiber with its bracket stages, got %+v", infos)
+		}
+		return infos[0].BracketStages
+	}
+	at := "the bracket at github.com/i-am-the-slime/go-ffi/purescript-aff.TestFiberDebugBrackets"
+	if got := stages(); len(got) != 1 || !strings.HasPrefix(got[0], "acquiring "+at) {
+		t.Errorf("Expected the fiber acquiring the bracket made here, got %q", got)
+	}
+	if dump := DumpFibers(); !strings.Contains(dump, "in 1 bracket(s): acquiring "+at) {
+		t.Errorf("Expected the dump to name the bracket, got %q", dump)
+	}
+
+	// Once acquired, the body completes and the release waits
+	close(acquired)
+	deadline := time.Now().Add(time.Second)
+	for got := stages(); len(got) != 1 || !strings.HasPrefix(got[0], "releasing (completed) "+at); got = stages() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the fiber releasing the bracket, got %q", got)
+		}
+		DrainEffectQueue()
+		time.Sleep(time.Millisecond)
+	}
+
+	close(released)
+	RunEventLoop()
+	if infos := FiberSnapshot(); len(infos) != 0 {
+		t.Errorf("Expected no fibers, got %v", infos)
+	}
+}
+
+func TestFiberDebugHandler(t *testing.T) {
+	EnableFiberDebug(true)
+	defer EnableFiberDebug(false)
+	fiber := Fiber(makeUtil(), nil, MakePure(nil)).(Dict)
+
+	recorder := httptest.NewRecorder()
+	FiberDebugHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/fibers?format=json", nil))
+	var infos []FiberInfo
+	if err := json.Unmarshal(recorder.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Status != "SUSPENDED" {
+		t.Errorf("Expected one suspended fiber, got %v", infos)
+	}
+	Run(fiber["run"])
+}
+
+// reportingT records the failures CheckLeaks reports
+type reportingT struct {
+	cleanups []func()
+	errors   []string
+}
+
+func (r *reportingT) Helper()          {}
+func (r *reportingT) Cleanup(f func()) { r.cleanups = append(r.cleanups, f) }
+func (r *reportingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *reportingT) finish() string {
+	for _, f := range r.cleanups {
+		f()
+	}
+	return strings.Join(r.errors, "\n")
+}
+
+func TestCheckLeaksAsyncNeverResumed(t *testing.T) {
+	r := &reportingT{}
+	CheckLeaks(r, 20*time.Millisecond)
+
+	never := Async{asyncFn: func(cb Any) Any {
+		return func() Any { return nonCanceler }
+	}}
+	start := time.Now()
+	result := launch(never)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected launchAff to give up after the deadline, waited %v", elapsed)
+	}
+	if result["Left"] == nil {
+		t.Errorf("Expected the leaked fiber to be killed, got %v", result)
+	}
+
+	report := r.finish()
+	if !strings.Contains(report, "1 fibers never completed") || !strings.Contains(report, "PENDING on Async") {
+		t.Errorf("Expected a report of the pending fiber, got %q", report)
+	}
+}
+
+func TestCheckLeaksTimersAndSupervisors(t *testing.T) {
+	exports := Foreign("Effect.Aff")
+	fork := exports["_fork"].(func(Any) Any)
+	r := &reportingT{}
+	CheckLeaks(r, 20*time.Millisecond)
+
+	// The supervised fiber forks a child that sleeps past the deadline
+	child := Apply(fork(true), Delay(time.Minute))
+	supervised := Run(exports["_makeSupervisedFiber"].(func(Any, Any) Any)(makeUtil(), MakeBind(child, func(Any) Any {
+		return Delay(time.Minute)
+	}))).(Dict)
+	Run(supervised["fiber"].(Dict)["run"])
+
+	report := r.finish()
+	for _, expected := range []string{"2 fibers never completed", "2 timers still armed", "supervisor 1 has 1 live children"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected the report to contain %q, got %q", expected, report)
+		}
+	}
+	if n := atomic.LoadInt64(&armedTimers); n != 0 {
+		t.Errorf("Expected the leaked timers to be stopped, %d still armed", n)
+	}
+}
+
+func TestCheckLeaksClean(t *testing.T) {
+	CheckLeaks(t, time.Second)
+	if result := launch(MakeBind(Delay(time.Millisecond), func(Any) Any { return MakePure(1) })); result["Right"] != 1 {
+		t.Errorf("Expected Right 1, got %v", result)
+	}
+}
+
+func TestForeignPanicsCaught(t *testing.T) {
+	exports := Foreign("Effect.Aff")
+	throwError := exports["_throwError"].(func(Any) Any)
+	errorFn := Foreign("Effect.Exception")["error"].(func(Any) Any)
+
+	// An Effect.Exception Error thrown into Aff
+	thrown := errorFn("bad input")
+	if result := launch(throwError(thrown)); result["Left"] != thrown {
+		t.Errorf("Expected the thrown Error, got %v", result)
+	}
+
+	// Panics in effects and binds become Errors that Catch recovers
+	catch := func(aff Any) Any {
+		return MakeCatch(aff, func(err Any) Any { return MakePure(err) })
+	}
+	var nilMap map[string]int
+	panics := []Any{
+		MakeSync(func() Any { panic("oops") }),
+		MakeSync(func() Any { nilMap["x"] = 1; return nil }),
+		MakeBind(MakePure(1), func(v Any) Any { return MakePure(v.(string)) }),
+		Async{asyncFn: func(cb Any) Any {
+			return func() Any { panic("async oops") }
+		}},
+	}
+	names := []string{"Error", "RuntimeError", "RuntimeError", "Error"}
+	for i, aff := range panics {
+		result := launch(catch(aff))
+		err, ok := result["Right"].(*exceptions.Error)
+		if !ok || err.Name != names[i] {
+			t.Errorf("Expected a caught %s, got %v", names[i], result)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package purescript_assert
 
 import (
 	"errors"
+	"time"
+
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
 	. "github.com/purescript-native/go-runtime"
 )
 
@@ -40,4 +43,24 @@ func init() {
 		}
 	}
 
+	// startLeakCheck :: Number -> Effect Unit
+	// Makes launchAff give up after the given number of milliseconds,
+	// recording fibers, timers and supervisors left behind (see
+	// Effect.Aff's test mode)
+	exports["startLeakCheck"] = func(millis Any) Any {
+		return func() Any {
+			aff.StartTestMode(time.Duration(millis.(float64) * float64(time.Millisecond)))
+			return nil
+		}
+	}
+
+	// assertNoLeaks :: Effect Unit
+	// Ends the leak check, failing with its report if anything leaked. Call
+	// it after launchAff returns rather than from inside the Aff
+	exports["assertNoLeaks"] = func() Any {
+		if err := aff.StopTestMode(); err != nil {
+			panic(err.Error())
+		}
+		return nil
+	}
 }
@@ -0,0 +1,69 @@
+package purescript_assert
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
+	. "github.com/purescript-native/go-runtime"
+)
+
+// launchAff runs an Aff as launchAff does, returning once the event loop
+// is idle or the leak check's deadline passes
+func launchAff(a Any) {
+	util := Dict{
+		"isLeft":    func(e Any) Any { _, ok := e.(Dict)["Left"]; return ok },
+		"fromLeft":  func(e Any) Any { return e.(Dict)["Left"] },
+		"fromRight": func(e Any) Any { return e.(Dict)["Right"] },
+		"left":      func(v Any) Any { return Dict{"Left": v} },
+		"right":     func(v Any) Any { return Dict{"Right": v} },
+	}
+	makeFiber := Foreign("Effect.Aff")["_makeFiber"].(func(Any, Any) Any)
+	Run(Run(makeFiber(util, a)).(Dict)["run"])
+}
+
+// assertNoLeaks runs the assertNoLeaks export, returning what it failed with
+func assertNoLeaks() (failure string) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure = fmt.Sprint(r)
+		}
+	}()
+	Run(Foreign("Test.Assert")["assertNoLeaks"])
+	return ""
+}
+
+func TestAssertNoLeaks(t *testing.T) {
+	exports := Foreign("Test.Assert")
+	startLeakCheck := exports["startLeakCheck"].(func(Any) Any)
+	fork := Foreign("Effect.Aff")["_fork"].(func(Any) Any)
+
+	// The fiber completes, leaving a child asleep on a timer
+	Run(startLeakCheck(20.0))
+	start := time.Now()
+	launchAff(aff.MakeBind(Apply(fork(true), aff.Delay(time.Minute)), func(Any) Any {
+		return aff.MakePure(nil)
+	}))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected launchAff to give up after the deadline, waited %v", elapsed)
+	}
+	report := assertNoLeaks()
+	if !strings.Contains(report, "1 fibers never completed") || !regexp.MustCompile(`fiber \d+ PENDING on \w+`).MatchString(report) {
+		t.Errorf("Expected the report to name the leaked fiber, got %q", report)
+	}
+	if !strings.Contains(report, "1 timers still armed") {
+		t.Errorf("Expected the report to name the leaked timer, got %q", report)
+	}
+
+	// Work that finishes by the deadline passes
+	Run(startLeakCheck(1000.0))
+	launchAff(aff.MakeBind(aff.Delay(time.Millisecond), func(Any) Any {
+		return aff.MakePure(nil)
+	}))
+	if report := assertNoLeaks(); report != "" {
+		t.Errorf("Expected no leaks, got %q", report)
+	}
+}
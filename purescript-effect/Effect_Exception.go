@@ -1,27 +1,27 @@
 package purescript_effect
 
 import (
-	"errors"
-
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
 	. "github.com/purescript-native/go-runtime"
 )
 
+// These match purescript-exceptions, which registers the rest of the module,
+// so errors look the same whichever package is imported
+
 func init() {
 	exports := Foreign("Effect.Exception")
 
-	exports["showErrorImpl"] = func(e_ Any) Any {
-		e := e_.(error)
-		return e.Error()
+	exports["showErrorImpl"] = func(e Any) Any {
+		return exceptions.Show(e)
 	}
 
 	exports["error"] = func(s_ Any) Any {
 		s := s_.(string)
-		return errors.New(s)
+		return exceptions.New(s)
 	}
 
-	exports["message"] = func(e_ Any) Any {
-		e := e_.(error)
-		return e.Error()
+	exports["message"] = func(e Any) Any {
+		return exceptions.Message(e)
 	}
 
 }
@@ -1,58 +1,104 @@
 package purescript_exceptions
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	. "github.com/purescript-native/go-runtime"
 )
 
 func init() {
-	exports := Foreign("Effect.Exception")
-
-	// Error type - represented as a dict with message and stack
-	type Error struct {
-		Message string
-		Stack   string
-	}
+	exports := RegisterExports("Effect.Exception")
 
 	// error :: String -> Error
 	exports["error"] = func(msg_ Any) Any {
 		msg := msg_.(string)
-		return Dict{
-			"message": msg,
-			"stack":   "",
-		}
+		return New(msg)
 	}
 
 	// message :: Error -> String
-	exports["message"] = func(err_ Any) Any {
-		if err, ok := err_.(Dict); ok {
-			if msg, ok := err["message"].(string); ok {
-				return msg
+	exports["message"] = func(err Any) Any {
+		return Message(err)
+	}
+
+	// errorWithCause :: String -> Error -> Error
+	exports["errorWithCause"] = func(msg_ Any, cause Any) Any {
+		msg := msg_.(string)
+		return WithCause(msg, ToError(cause))
+	}
+
+	// name :: Error -> String
+	exports["name"] = func(err Any) Any {
+		return Name(err)
+	}
+
+	// withName :: String -> Error -> Error
+	exports["withName"] = func(name_ Any, err Any) Any {
+		name := name_.(string)
+		e := copyError(err)
+		e.Name = name
+		return e
+	}
+
+	// withData :: Foreign -> Error -> Error
+	exports["withData"] = func(data Any, err Any) Any {
+		e := copyError(err)
+		e.Data = data
+		return e
+	}
+
+	// causeImpl :: (forall a. a -> Maybe a) -> (forall a. Maybe a) -> Error -> Maybe Error
+	exports["causeImpl"] = func(just Any) Any {
+		return func(nothing Any) Any {
+			return func(err Any) Any {
+				if cause := errors.Unwrap(ToError(err)); cause != nil {
+					return Apply(just, cause)
+				}
+				return nothing
+			}
+		}
+	}
+
+	// dataImpl :: (forall a. a -> Maybe a) -> (forall a. Maybe a) -> Error -> Maybe Foreign
+	exports["dataImpl"] = func(just Any) Any {
+		return func(nothing Any) Any {
+			return func(err Any) Any {
+				if data, ok := Data(err); ok {
+					return Apply(just, data)
+				}
+				return nothing
 			}
 		}
-		return fmt.Sprintf("%v", err_)
 	}
 
 	// stackImpl :: (forall a. a -> Maybe a) -> (forall a. Maybe a) -> Error -> Maybe String
 	// Takes Just and Nothing constructors, then Error
 	exports["stackImpl"] = func(just Any) Any {
 		return func(nothing Any) Any {
-			return func(err_ Any) Any {
-				if err, ok := err_.(Dict); ok {
-					if stack, ok := err["stack"].(string); ok && stack != "" {
-						return Apply(just, stack)
-					}
+			return func(err Any) Any {
+				if stack := Stack(err); stack != "" {
+					return Apply(just, stack)
 				}
 				return nothing
 			}
 		}
 	}
 
+	// showErrorImpl :: Error -> String
+	exports["showErrorImpl"] = func(err Any) Any {
+		return Show(err)
+	}
+
 	// throwException :: forall a. Error -> Effect a
-	exports["throwException"] = func(err_ Any) Any {
+	exports["throwException"] = func(err Any) Any {
 		return func() Any {
-			panic(err_)
+			panic(err)
 		}
 	}
 
@@ -60,10 +106,7 @@ func init() {
 	exports["throw"] = func(msg_ Any) Any {
 		return func() Any {
 			msg := msg_.(string)
-			panic(Dict{
-				"message": msg,
-				"stack":   "",
-			})
+			panic(New(msg))
 		}
 	}
 
@@ -71,18 +114,7 @@ func init() {
 	exports["try"] = func(effect_ Any) Any {
 		return func() Any {
 			effect := effect_.(func() Any)
-			
-			// Catch panics
-			defer func() {
-				if r := recover(); r != nil {
-					// This would be handled in the outer context
-					panic(r)
-				}
-			}()
-			
-			// Try to run the effect
-			result := tryRun(effect)
-			return result
+			return tryRun(effect)
 		}
 	}
 
@@ -93,33 +125,11 @@ func init() {
 			return func() Any {
 				handler := handler_.(func(Any) Any)
 				effect := effect_.(func() Any)
-				
-				// Catch panics and handle them
-				var result Any
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							// Convert panic to error
-							var err Dict
-							if e, ok := r.(Dict); ok {
-								err = e
-							} else {
-								err = Dict{
-									"message": fmt.Sprintf("%v", r),
-									"stack":   "",
-								}
-							}
-							
-							// Call handler
-							handlerEffect := handler(err).(func() Any)
-							result = handlerEffect()
-						}
-					}()
-					
-					result = effect()
-				}()
-				
-				return result
+				value, err := Recover(effect)
+				if err != nil {
+					return handler(err).(func() Any)()
+				}
+				return value
 			}
 		}
 	}
@@ -131,11 +141,11 @@ func init() {
 			return func() Any {
 				finalizer := finalizer_.(func() Any)
 				effect := effect_.(func() Any)
-				
+
 				defer func() {
 					finalizer()
 				}()
-				
+
 				return effect()
 			}
 		}
@@ -144,31 +154,349 @@ func init() {
 
 // tryRun executes an effect and catches panics, returning Either Error a
 func tryRun(effect func() Any) Any {
-	var result Any
-	caught := false
-	var caughtErr Any
-	
-	func() {
-		defer func() {
-			if r := recover(); r != nil {
-				caught = true
-				// Convert panic to error dict
-				if e, ok := r.(Dict); ok {
-					caughtErr = e
-				} else {
-					caughtErr = Dict{
-						"message": fmt.Sprintf("%v", r),
-						"stack":   "",
-					}
+	value, err := Recover(effect)
+	if err != nil {
+		return Dict{"Left": err}
+	}
+	return Dict{"Right": value}
+}
+
+// Error is the runtime representation of Effect.Exception's Error. Every
+// package throws it, and panics of other values are converted to it when
+// they are caught.
+type Error struct {
+	Message string
+	Name    string // "Error" unless a more specific name applies
+	Stack   string // set to override the captured stack
+	Cause   error  // optional
+	Data    Any    // optional payload for handlers to inspect
+
+	pcs       []uintptr // captured where the error was created or recovered
+	stackOnce sync.Once
+	stack     string
+}
+
+// New creates an Error with the given message
+func New(message string) *Error {
+	return &Error{Message: message, Name: "Error", pcs: callers()}
+}
+
+// Errorf creates an Error with a formatted message. As with fmt.Errorf, an
+// error formatted with %w becomes the cause.
+func Errorf(format string, args ...interface{}) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Message: err.Error(), Name: "Error", Cause: errors.Unwrap(err), pcs: callers()}
+}
+
+// WithCause creates an Error caused by another error. Unlike Errorf with
+// %w, the cause's message isn't added to the message.
+func WithCause(message string, cause error) *Error {
+	return &Error{Message: message, Name: "Error", Cause: cause, pcs: callers()}
+}
+
+// copyError copies an error value, so an Error can be changed without
+// changing errors shared with other code. The stack is kept.
+func copyError(err Any) *Error {
+	e, ok := err.(*Error)
+	if !ok {
+		return FromPanic(err)
+	}
+	return &Error{Message: e.Message, Name: e.Name, Stack: e.Stack, Cause: e.Cause, Data: e.Data, pcs: e.pcs}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the cause, for errors.Is and errors.As
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// String formats the error as JavaScript does: its name and message
+func (e *Error) String() string {
+	if e.Name == "" {
+		return e.Message
+	}
+	return e.Name + ": " + e.Message
+}
+
+// Recover runs effect, returning what it panics with as an Error
+func Recover(effect func() Any) (value Any, err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = FromPanic(r)
+		}
+	}()
+	return effect(), nil
+}
+
+// FromPanic converts a value recovered from a panic to an Error. Go errors
+// are kept as the cause, so errors.Is and errors.As still find them.
+func FromPanic(r Any) *Error {
+	switch e := r.(type) {
+	case *Error:
+		return e
+	case runtime.Error:
+		return &Error{Message: e.Error(), Name: "RuntimeError", Cause: e, pcs: callers()}
+	case error:
+		return &Error{Message: e.Error(), Name: "Error", Cause: e, pcs: callers()}
+	case string:
+		return New(e)
+	case Dict:
+		// The representation used before Error existed
+		if message, ok := e["message"].(string); ok {
+			stack, _ := e["stack"].(string)
+			return &Error{Message: message, Name: "Error", Stack: stack, pcs: callers()}
+		}
+	}
+	return Errorf("%v", r)
+}
+
+// ToError converts a thrown value to a Go error, keeping errors as they are
+func ToError(v Any) error {
+	if err, ok := v.(error); ok {
+		return err
+	}
+	return FromPanic(v)
+}
+
+// Message returns the message of an error value
+func Message(err Any) string {
+	return ToError(err).Error()
+}
+
+// Name returns the name of an error value, "Error" unless it is an Error
+// with a more specific one
+func Name(err Any) string {
+	var e *Error
+	if errors.As(ToError(err), &e) && e.Name != "" {
+		return e.Name
+	}
+	return "Error"
+}
+
+// Data returns the payload attached to an error value, if it is an Error
+// with one
+func Data(err Any) (Any, bool) {
+	var e *Error
+	if errors.As(ToError(err), &e) && e.Data != nil {
+		return e.Data, true
+	}
+	return nil, false
+}
+
+// Stack returns the stack of an error value, or "" if it has none
+func Stack(err Any) string {
+	var e *Error
+	if errors.As(ToError(err), &e) {
+		return e.StackTrace()
+	}
+	return ""
+}
+
+// StackTrace formats the stack captured when the error was created, or
+// when the panic it came from was recovered, as JavaScript does. Frames of
+// generated code and FFI exports are shown with their PureScript names.
+func (e *Error) StackTrace() string {
+	if e.Stack != "" {
+		return e.Stack
+	}
+	e.stackOnce.Do(func() {
+		if len(e.pcs) > 0 {
+			e.stack = e.String() + "\n" + formatStack(e.pcs)
+		}
+	})
+	return e.stack
+}
+
+// captureStacks is 1 while errors capture their stacks
+var captureStacks int32 = 1
+
+// SetStackCapture turns stack capture on or off. Capturing costs a walk of
+// the stack for every error, which hot paths that throw and catch often
+// may not want; errors created while it is off have no stack.
+func SetStackCapture(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&captureStacks, value)
+}
+
+// maxFrames limits how much of the stack an error keeps
+const maxFrames = 32
+
+func callers() []uintptr {
+	if atomic.LoadInt32(&captureStacks) == 0 {
+		return nil
+	}
+	pcs := make([]uintptr, maxFrames)
+	// Skip runtime.Callers and callers itself
+	return pcs[:runtime.Callers(2, pcs)]
+}
+
+// formatStack writes one "    at name (file:line)" line per frame, leaving
+// out the Go runtime, the purescript-native runtime and this package
+func formatStack(pcs []uintptr) string {
+	var out strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if !hiddenFrame(frame) {
+			fmt.Fprintf(&out, "    at %s (%s:%d)\n", demangle(frame), frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+const (
+	thisPackage    = "github.com/i-am-the-slime/go-ffi/purescript-exceptions."
+	runtimePackage = "github.com/purescript-native/go-runtime."
+)
+
+func hiddenFrame(frame runtime.Frame) bool {
+	name := frame.Function
+	switch {
+	case strings.HasPrefix(name, "runtime."), strings.HasPrefix(name, runtimePackage):
+		return true
+	case strings.HasPrefix(name, thisPackage):
+		return !strings.HasSuffix(frame.File, "_test.go")
+	}
+	return false
+}
+
+// FrameName names a stack frame as stack traces do, with its PureScript
+// name where it has one
+func FrameName(frame runtime.Frame) string {
+	return demangle(frame)
+}
+
+// demangle turns a Go function name back into a PureScript one where it
+// can. Generated code lives in a package per module, named with
+// underscores for dots (Data_Maybe), with values prefixed PS__. FFI code
+// is in a file per module named the same way, and its exports are closures
+// found through the exports the module registered (see RegisterExports).
+func demangle(frame runtime.Frame) string {
+	name := frame.Function
+	pkgPath, local := splitFuncName(name)
+	pkg := pkgPath[strings.LastIndex(pkgPath, "/")+1:]
+
+	if strings.HasPrefix(local, "PS__") {
+		parts := strings.SplitN(local, ".", 2)
+		demangled := strings.Replace(pkg, "_", ".", -1) + "." + unescape(strings.TrimPrefix(parts[0], "PS__"))
+		if len(parts) == 2 {
+			demangled += " <anonymous>"
+		}
+		return demangled
+	}
+
+	// Only FFI package files are looked up
+	base := filepath.Base(frame.File)
+	dir := filepath.Base(filepath.Dir(frame.File))
+	if strings.HasPrefix(dir, "purescript-") && strings.HasSuffix(base, ".go") && !strings.HasSuffix(base, "_test.go") {
+		module := strings.Replace(strings.TrimSuffix(base, ".go"), "_", ".", -1)
+		if export, nested, ok := lookupExport(module, name); ok {
+			if nested {
+				return module + "." + export + " <anonymous>"
+			}
+			return module + "." + export
+		}
+	}
+	return name
+}
+
+// splitFuncName splits a Go function name into its package path and the
+// rest, which may name a method or closures (init.func3.1)
+func splitFuncName(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return name, ""
+	}
+	return name[:slash+1+dot], name[slash+1+dot+1:]
+}
+
+// unescape undoes the escaping of characters Go identifiers can't contain
+func unescape(name string) string {
+	return strings.Replace(strings.Replace(name, "_prime", "'", -1), "_dollar", "$", -1)
+}
+
+// exportNames maps the Go function names of each registered module's
+// exports to the export names, built the first time a module's frames are
+// demangled
+var exportNames = struct {
+	sync.Mutex
+	exports map[string]Dict
+	modules map[string]map[string]string
+}{exports: map[string]Dict{}, modules: map[string]map[string]string{}}
+
+// RegisterExports returns a module's foreign exports, as Foreign does, and
+// lets stack traces name the FFI functions it exports. FFI packages call it
+// in init in place of Foreign; frames of modules that don't keep their Go
+// names.
+func RegisterExports(module string) Dict {
+	exports := Foreign(module)
+	exportNames.Lock()
+	defer exportNames.Unlock()
+	exportNames.exports[module] = exports
+	return exports
+}
+
+// lookupExport finds the export a function belongs to, as the export
+// itself or as a closure inside it. Modules that weren't registered are
+// skipped.
+func lookupExport(module string, function string) (export string, nested bool, ok bool) {
+	exportNames.Lock()
+	names, found := exportNames.modules[module]
+	if !found {
+		exports, registered := exportNames.exports[module]
+		if !registered {
+			exportNames.Unlock()
+			return "", false, false
+		}
+		names = map[string]string{}
+		for key, value := range exports {
+			v := reflect.ValueOf(value)
+			if v.Kind() == reflect.Func && !v.IsNil() {
+				if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+					names[fn.Name()] = key
 				}
 			}
-		}()
-		
-		result = effect()
-	}()
-	
-	if caught {
-		return Dict{"Left": caughtErr}
+		}
+		exportNames.modules[module] = names
+	}
+	exportNames.Unlock()
+
+	for name := function; ; {
+		if export, ok := names[name]; ok {
+			return export, name != function, true
+		}
+		dot := strings.LastIndex(name, ".")
+		if dot < 0 || !strings.HasPrefix(name[dot+1:], "func") && !isDigits(name[dot+1:]) {
+			return "", false, false
+		}
+		name = name[:dot]
+	}
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Show formats an error value as Effect.Exception's Show instance does:
+// the stack if there is one, or the name and message
+func Show(err Any) string {
+	if stack := Stack(err); stack != "" {
+		return stack
 	}
-	return Dict{"Right": result}
+	return Name(err) + ": " + Message(err)
 }
@@ -1,6 +1,11 @@
 package purescript_exceptions
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	. "github.com/purescript-native/go-runtime"
@@ -10,10 +15,10 @@ func TestError(t *testing.T) {
 	exports := Foreign("Effect.Exception")
 	errorFn := exports["error"].(func(Any) Any)
 	
-	err := errorFn("Test error").(Dict)
+	err := errorFn("Test error").(*Error)
 	
-	if err["message"] != "Test error" {
-		t.Errorf("Expected message 'Test error', got '%v'", err["message"])
+	if err.Message != "Test error" || err.Name != "Error" {
+		t.Errorf("Expected message 'Test error', got '%v'", err)
 	}
 }
 
@@ -64,16 +69,16 @@ func TestTryWithError(t *testing.T) {
 	if leftVal, ok := result["Left"]; !ok {
 		t.Error("Expected Left for failing effect")
 	} else {
-		err := leftVal.(Dict)
-		if err["message"] != "Something went wrong" {
-			t.Errorf("Expected error message 'Something went wrong', got '%v'", err["message"])
+		err := leftVal.(*Error)
+		if err.Message != "Something went wrong" {
+			t.Errorf("Expected error message 'Something went wrong', got '%v'", err.Message)
 		}
 	}
 }
 
 func TestCatchException(t *testing.T) {
 	exports := Foreign("Effect.Exception")
-	catchException := exports["catchException"].(func(Any, Any) Any)
+	catchException := exports["catchException"].(func(Any) Any)
 	
 	// Handler that returns a default value
 	handler := func(err Any) Any {
@@ -87,7 +92,7 @@ func TestCatchException(t *testing.T) {
 		panic(Dict{"message": "error", "stack": ""})
 	}
 	
-	catchEffect := catchException(handler, effect).(func() Any)
+	catchEffect := catchException(handler).(func(Any) Any)(effect).(func() Any)
 	result := catchEffect()
 	
 	if result != "handled" {
@@ -97,7 +102,7 @@ func TestCatchException(t *testing.T) {
 
 func TestCatchExceptionSuccess(t *testing.T) {
 	exports := Foreign("Effect.Exception")
-	catchException := exports["catchException"].(func(Any, Any) Any)
+	catchException := exports["catchException"].(func(Any) Any)
 	
 	// Handler that shouldn't be called
 	handler := func(err Any) Any {
@@ -111,7 +116,7 @@ func TestCatchExceptionSuccess(t *testing.T) {
 		return "success"
 	}
 	
-	catchEffect := catchException(handler, effect).(func() Any)
+	catchEffect := catchException(handler).(func(Any) Any)(effect).(func() Any)
 	result := catchEffect()
 	
 	if result != "success" {
@@ -121,7 +126,7 @@ func TestCatchExceptionSuccess(t *testing.T) {
 
 func TestFinally(t *testing.T) {
 	exports := Foreign("Effect.Exception")
-	finally := exports["finally"].(func(Any, Any) Any)
+	finally := exports["finally"].(func(Any) Any)
 	
 	finalized := false
 	
@@ -136,7 +141,7 @@ func TestFinally(t *testing.T) {
 		return "done"
 	}
 	
-	finallyEffect := finally(finalizer, effect).(func() Any)
+	finallyEffect := finally(finalizer).(func(Any) Any)(effect).(func() Any)
 	result := finallyEffect()
 	
 	if result != "done" {
@@ -150,7 +155,7 @@ func TestFinally(t *testing.T) {
 
 func TestFinallyWithError(t *testing.T) {
 	exports := Foreign("Effect.Exception")
-	finally := exports["finally"].(func(Any, Any) Any)
+	finally := exports["finally"].(func(Any) Any)
 	
 	finalized := false
 	
@@ -165,7 +170,7 @@ func TestFinallyWithError(t *testing.T) {
 		panic("error")
 	}
 	
-	finallyEffect := finally(finalizer, effect).(func() Any)
+	finallyEffect := finally(finalizer).(func(Any) Any)(effect).(func() Any)
 	
 	defer func() {
 		if r := recover(); r == nil {
@@ -190,9 +195,9 @@ func TestThrow(t *testing.T) {
 		if r := recover(); r == nil {
 			t.Error("Expected panic")
 		} else {
-			err := r.(Dict)
-			if err["message"] != "Test error" {
-				t.Errorf("Expected 'Test error', got '%v'", err["message"])
+			err := r.(*Error)
+			if err.Message != "Test error" {
+				t.Errorf("Expected 'Test error', got '%v'", err.Message)
 			}
 		}
 	}()
@@ -200,3 +205,186 @@ func TestThrow(t *testing.T) {
 	effect()
 }
 
+func TestForeignPanics(t *testing.T) {
+	exports := Foreign("Effect.Exception")
+	tryFn := exports["try"].(func(Any) Any)
+	catchException := exports["catchException"].(func(Any) Any)
+
+	cause := errors.New("disk full")
+	var nilMap map[string]int
+	tests := []struct {
+		name    string
+		effect  func() Any
+		message string
+		errName string
+	}{
+		{"go error", func() Any { panic(cause) }, "disk full", "Error"},
+		{"string", func() Any { panic("oops") }, "oops", "Error"},
+		{"runtime error", func() Any { nilMap["x"] = 1; return nil }, "assignment to entry in nil map", "RuntimeError"},
+		{"type assertion", func() Any { var v Any = 1; return v.(string) }, "interface conversion: interface {} is int, not string", "RuntimeError"},
+		{"other value", func() Any { panic(42) }, "42", "Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left := Run(tryFn(tt.effect)).(Dict)["Left"]
+			err, ok := left.(*Error)
+			if !ok || err.Message != tt.message || err.Name != tt.errName {
+				t.Fatalf("Expected %s: %s from try, got %#v", tt.errName, tt.message, left)
+			}
+
+			var caught Any
+			Run(catchException(func(e Any) Any {
+				return func() Any {
+					caught = e
+					return nil
+				}
+			}).(func(Any) Any)(tt.effect))
+			if caught.(*Error).Message != tt.message {
+				t.Errorf("Expected catchException to see the same error, got %v", caught)
+			}
+		})
+	}
+
+	left := Run(tryFn(func() Any { panic(cause) })).(Dict)["Left"].(error)
+	if !errors.Is(left, cause) {
+		t.Errorf("Expected the Go error as the cause, got %v", left)
+	}
+	if show := exports["showErrorImpl"].(func(Any) Any)(left).(string); !strings.HasPrefix(show, "Error: disk full\n    at ") {
+		t.Errorf("Expected Error: disk full and its stack, got %v", show)
+	}
+}
+
+func TestStack(t *testing.T) {
+	exports := Foreign("Effect.Exception")
+	stackImpl := exports["stackImpl"].(func(Any) Any)
+	just := func(v Any) Any { return Dict{"value0": v} }
+	stackOf := func(err Any) Dict {
+		return stackImpl(just).(func(Any) Any)(Dict{}).(func(Any) Any)(err).(Dict)
+	}
+
+	err := exports["error"].(func(Any) Any)("Test error")
+	stack, ok := stackOf(err)["value0"].(string)
+	if !ok {
+		t.Fatal("Expected Just a stack")
+	}
+	lines := strings.Split(stack, "\n")
+	if lines[0] != "Error: Test error" || !strings.Contains(lines[1], "TestStack (") || !strings.Contains(lines[1], "Effect_Exception_test.go:") {
+		t.Errorf("Expected the stack to start at the test, got %q", stack)
+	}
+
+	// Panics are traced to where they happened
+	left := Run(exports["try"].(func(Any) Any)(func() Any { panic("here") })).(Dict)["Left"]
+	if stack := Stack(left); !strings.Contains(stack, "TestStack.func") {
+		t.Errorf("Expected the stack to include the panicking function, got %q", stack)
+	}
+
+	SetStackCapture(false)
+	defer SetStackCapture(true)
+	if len(stackOf(New("fast"))) != 0 {
+		t.Error("Expected Nothing while capture is off")
+	}
+}
+
+func TestDemangle(t *testing.T) {
+	generated := runtime.Frame{
+		Function: "project.localhost/purescript-native/output/Data.Maybe/Data_Maybe.PS__fromMaybe_prime.func1",
+		File:     "/output/Data.Maybe/Data_Maybe.go",
+	}
+	if name := demangle(generated); name != "Data.Maybe.fromMaybe' <anonymous>" {
+		t.Errorf("Expected Data.Maybe.fromMaybe' <anonymous>, got %s", name)
+	}
+
+	// FFI closures are found through the module's exports
+	throw := runtime.FuncForPC(reflect.ValueOf(Foreign("Effect.Exception")["throw"]).Pointer())
+	file, _ := throw.FileLine(throw.Entry())
+	if name := demangle(runtime.Frame{Function: throw.Name(), File: file}); name != "Effect.Exception.throw" {
+		t.Errorf("Expected Effect.Exception.throw, got %s", name)
+	}
+	if name := demangle(runtime.Frame{Function: throw.Name() + ".1", File: file}); name != "Effect.Exception.throw <anonymous>" {
+		t.Errorf("Expected Effect.Exception.throw <anonymous>, got %s", name)
+	}
+
+	// Modules that weren't registered keep their Go names
+	missing := runtime.Frame{Function: "example.com/purescript-missing.init.func1", File: "/src/purescript-missing/Data_Missing.go"}
+	if name := demangle(missing); name != missing.Function {
+		t.Errorf("Expected an unknown module's functions unchanged, got %s", name)
+	}
+
+	other := runtime.Frame{Function: "net/http.(*Server).Serve", File: "/usr/local/go/src/net/http/server.go"}
+	if name := demangle(other); name != other.Function {
+		t.Errorf("Expected other functions unchanged, got %s", name)
+	}
+}
+
+func TestErrorWithCause(t *testing.T) {
+	exports := Foreign("Effect.Exception")
+	errorWithCause := exports["errorWithCause"].(func(Any, Any) Any)
+	causeImpl := exports["causeImpl"].(func(Any) Any)
+	just := func(v Any) Any { return Dict{"value0": v} }
+	causeOf := func(err Any) Dict {
+		return causeImpl(just).(func(Any) Any)(Dict{}).(func(Any) Any)(err).(Dict)
+	}
+
+	// Go errors raised by FFI code and PureScript errors both work as causes
+	constraint := errors.New("UNIQUE constraint failed: users.email")
+	wrapped := errorWithCause("Failed to save user", errorWithCause("Insert failed", constraint)).(*Error)
+	if wrapped.Message != "Failed to save user" {
+		t.Errorf("Expected the message to be kept, got %q", wrapped.Message)
+	}
+	inner, ok := causeOf(wrapped)["value0"].(*Error)
+	if !ok || inner.Message != "Insert failed" {
+		t.Fatalf("Expected Just the inner error, got %v", causeOf(wrapped))
+	}
+	if causeOf(inner)["value0"] != constraint {
+		t.Errorf("Expected Just the Go error, got %v", causeOf(inner))
+	}
+	if len(causeOf(constraint)) != 0 || len(causeOf(New("alone"))) != 0 {
+		t.Error("Expected Nothing for errors without a cause")
+	}
+
+	if !errors.Is(wrapped, constraint) {
+		t.Error("Expected errors.Is to find the Go error through the chain")
+	}
+	var target *Error
+	if !errors.As(error(WithCause("outer", error(inner))), &target) || target.Message != "outer" {
+		t.Errorf("Expected errors.As to find an Error, got %v", target)
+	}
+}
+
+func TestErrorNameAndData(t *testing.T) {
+	exports := Foreign("Effect.Exception")
+	name := exports["name"].(func(Any) Any)
+	withName := exports["withName"].(func(Any, Any) Any)
+	withData := exports["withData"].(func(Any, Any) Any)
+	dataImpl := exports["dataImpl"].(func(Any) Any)
+	just := func(v Any) Any { return Dict{"value0": v} }
+	dataOf := func(err Any) Dict {
+		return dataImpl(just).(func(Any) Any)(Dict{}).(func(Any) Any)(err).(Dict)
+	}
+
+	original := New("request timed out")
+	timeout := withData(Dict{"url": "/users", "ms": 5000.0}, withName("TimeoutError", original)).(*Error)
+	if name(timeout) != "TimeoutError" || name(original) != "Error" {
+		t.Errorf("Expected TimeoutError without changing the original, got %v and %v", name(timeout), name(original))
+	}
+	if Show(timeout) != Stack(timeout) || !strings.HasPrefix(Show(timeout), "TimeoutError: request timed out\n") {
+		t.Errorf("Expected the name in the stack, got %q", Show(timeout))
+	}
+	if data, ok := dataOf(timeout)["value0"].(Dict); !ok || data["url"] != "/users" {
+		t.Errorf("Expected Just the payload, got %v", dataOf(timeout))
+	}
+	if len(dataOf(original)) != 0 || len(dataOf(errors.New("plain"))) != 0 {
+		t.Error("Expected Nothing for errors without a payload")
+	}
+	// As with name, the payload is found through Go errors wrapping an Error
+	wrapped := fmt.Errorf("retrying: %w", timeout)
+	if data, ok := dataOf(wrapped)["value0"].(Dict); !ok || data["ms"] != 5000.0 || name(wrapped) != "TimeoutError" {
+		t.Errorf("Expected the payload of the wrapped Error, got %v", dataOf(wrapped))
+	}
+
+	// Go code can read the payload of PureScript errors it wraps
+	var thrown *Error
+	if err := Errorf("fetch failed: %w", timeout); !errors.As(err.Cause, &thrown) || thrown.Data.(Dict)["ms"] != 5000.0 {
+		t.Errorf("Expected the payload through errors.As, got %v", thrown)
+	}
+}
@@ -2,165 +2,235 @@ package purescript_fetch
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	neturl "net/url"
+	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
 	. "github.com/purescript-native/go-runtime"
 )
 
+// Errors reported when a fetch is aborted before it completes
+var (
+	ErrTimeout   = errors.New("fetch: request timed out")
+	ErrCancelled = errors.New("fetch: request cancelled")
+	ErrBodyUsed  = errors.New("fetch: body has already been consumed")
+)
+
+// Names of the errors a fetch fails with. Every fetch error is an
+// Effect.Exception Error whose name says why the fetch failed; HTTP errors
+// from ensureOk carry the response in their data.
+const (
+	NameFetch             = "FetchError"
+	NameTimeout           = "TimeoutError"
+	NameConnectionRefused = "ConnectionRefusedError"
+	NameTLS               = "TLSError"
+	NameDNS               = "DNSError"
+	NameCancelled         = "CancelledError"
+	NameBodyRead          = "BodyReadError"
+	NameHTTP              = "HTTPError"
+)
+
+// maxErrorBody is how much of a response body an HTTP error keeps
+const maxErrorBody = 1024
+
+// fetchFailure creates a fetch error with the given name, caused by err
+func fetchFailure(name string, message string, cause error) *exceptions.Error {
+	e := exceptions.WithCause(message, cause)
+	e.Name = name
+	return e
+}
+
+// noBody is the error reading a response without a body fails with
+func noBody() *exceptions.Error {
+	return fetchFailure(NameBodyRead, "fetch: no body in response", nil)
+}
+
 func init() {
-	exports := Foreign("Fetch")
+	exports := exceptions.RegisterExports("Fetch")
 
-	// Helper to create async fetch operation
-	makeAsyncFetch := func(url_ Any, options_ Any) Any {
+	// fetchAff creates the Aff for a request
+	fetchAff := func(client *Client, url_ Any, options_ Any) Any {
 		url := url_.(string)
 		options := options_.(Dict)
-		
-		// Create the async effect that returns a canceler
-		return func(callback_ Any) Any {
-			return func() Any {
-				callback := callback_.(func(Any) Any)
-				
-				// Build request
-				method := "GET"
-				if m, ok := options["method"].(string); ok {
-					method = strings.ToUpper(m)
-				}
-				
-				var body io.Reader
-				if b, ok := options["body"].(string); ok {
-					body = strings.NewReader(b)
-				}
-				
-				req, err := http.NewRequest(method, url, body)
-				if err != nil {
-					// Call callback with Left (error)
-					Apply(callback, Dict{"Left": err.Error()})
-					// Return canceler (no-op)
-					return func() Any { return nil }
-				}
-				
-				// Set headers
-				if headers, ok := options["headers"].(Dict); ok {
-					for key, value := range headers {
-						if val, ok := value.(string); ok {
-							req.Header.Set(key, val)
-						}
-					}
-				}
-				
-				// Make request in goroutine
-				done := make(chan struct{})
-				go func() {
-					defer close(done)
-					
-					resp, err := http.DefaultClient.Do(req)
-					if err != nil {
-						// Call callback with Left (error)
-						Apply(callback, Dict{"Left": err.Error()})
-						return
-					}
-					
-					// Read body
-					bodyBytes, err := io.ReadAll(resp.Body)
-					resp.Body.Close()
-					if err != nil {
-						Apply(callback, Dict{"Left": err.Error()})
-						return
-					}
-					
-					// Build headers dict
-					respHeaders := make(Dict)
-					for key, values := range resp.Header {
-						respHeaders[strings.ToLower(key)] = strings.Join(values, ", ")
-					}
-					
-					// Build response object
-					response := Dict{
-						"status":     resp.StatusCode,
-						"statusText": resp.Status,
-						"headers":    respHeaders,
-						"body":       string(bodyBytes),
-						"url":        url,
-						"ok":         resp.StatusCode >= 200 && resp.StatusCode < 300,
-					}
-					
-					// Call callback with Right (success)
-					Apply(callback, Dict{"Right": response})
-				}()
-				
-				// Return canceler function
-				return func() Any {
-					// Could cancel the request here if needed
-					return nil
+
+		// A retrying around this fetch, if any, is in the fiber's locals
+		return aff.ReadLocal(retryScopeKey, func(scope Any, retried bool) Any {
+			return fetchRequest(client, url, options, func(req *http.Request) {
+				if retried {
+					scope.(*retryScope).record(req)
 				}
-			}
-		}
+			})
+		})
 	}
 
+	// timeoutError :: Error
+	// An error like the one a fetch fails with when the `timeout` option
+	// expires
+	exports["timeoutError"] = fetchFailure(NameTimeout, ErrTimeout.Error(), ErrTimeout)
+
+	// cancelledError :: Error
+	// An error like the one a fetch fails with when it is cancelled
+	exports["cancelledError"] = fetchFailure(NameCancelled, ErrCancelled.Error(), ErrCancelled)
+
 	// fetch :: String -> Aff Response
 	exports["fetch"] = func(url_ Any) Any {
-		return makeAsyncFetch(url_, Dict{})
+		return fetchAff(defaultClient, url_, Dict{})
 	}
 
 	// fetch' :: String -> Options -> Aff Response
 	exports["fetch'"] = func(url_ Any, options_ Any) Any {
-		return makeAsyncFetch(url_, options_)
+		return fetchAff(defaultClient, url_, options_)
 	}
 
-	// text :: Response -> Aff String
-	exports["text"] = func(response_ Any) Any {
-		return func(callback_ Any) Any {
-			return func() Any {
-				callback := callback_.(func(Any) Any)
-				response := response_.(Dict)
-				
-				if body, ok := response["body"].(string); ok {
-					Apply(callback, Dict{"Right": body})
-				} else {
-					Apply(callback, Dict{"Left": "No body in response"})
-				}
-				
-				return func() Any { return nil }
+	// newClient :: ClientOptions -> Effect Client
+	exports["newClient"] = func(options_ Any) Any {
+		return func() Any {
+			options := options_.(Dict)
+			client, err := newClient(options)
+			if err != nil {
+				panic(exceptions.Errorf("Failed to create client: %w", err))
 			}
+			return client
 		}
 	}
 
-	// json :: Response -> Aff Json
-	exports["json"] = func(response_ Any) Any {
-		return func(callback_ Any) Any {
-			return func() Any {
-				callback := callback_.(func(Any) Any)
-				response := response_.(Dict)
-				
-				// Just return the body string - PureScript will parse it
-				if body, ok := response["body"].(string); ok {
-					Apply(callback, Dict{"Right": body})
-				} else {
-					Apply(callback, Dict{"Left": "No body in response"})
+	// fetchWith :: Client -> String -> Options -> Aff Response
+	exports["fetchWith"] = func(client_ Any, url_ Any, options_ Any) Any {
+		client := client_.(*Client)
+		return fetchAff(client, url_, options_)
+	}
+
+	// Helper to read the response body once, decoding it in the background
+	readBody := func(response_ Any, decode func([]byte) (Any, error)) Any {
+		return aff.MakeGoAsync(func(onError func(Any), onSuccess func(Any)) aff.Canceler {
+			response := response_.(Dict)
+
+			body, ok := response["_body"].(*responseBody)
+			if !ok {
+				onError(noBody())
+				return nonCanceler
+			}
+
+			go func() {
+				data, err := body.consume()
+				if err != nil {
+					onError(err)
+					return
+				}
+				value, err := decode(data)
+				if err != nil {
+					onError(fetchFailure(NameBodyRead, "fetch: "+err.Error(), err))
+					return
 				}
-				
-				return func() Any { return nil }
+				onSuccess(value)
+			}()
+
+			return aff.ContextCanceler(body.cancel)
+		})
+	}
+
+	// bodyStream :: Response -> Aff (Stream Buffer)
+	// Reads the body in chunks as they arrive (see Fetch.Stream)
+	exports["bodyStream"] = func(response_ Any) Any {
+		return aff.MakeGoAsync(func(onError func(Any), onSuccess func(Any)) aff.Canceler {
+			response := response_.(Dict)
+			body, ok := response["_body"].(*responseBody)
+			if !ok {
+				onError(noBody())
+				return nonCanceler
 			}
-		}
+			if err := body.claim(); err != nil {
+				onError(err)
+				return nonCanceler
+			}
+			onSuccess(body.stream())
+			return nonCanceler
+		})
+	}
+
+	// retrying :: RetryPolicy -> Aff Response -> Aff Response
+	exports["retrying"] = func(policy_ Any, aff_ Any) Any {
+		policy := newRetryPolicy(policy_.(Dict))
+		return retrying(policy, aff_, 0)
+	}
+
+	// text :: Response -> Aff String
+	exports["text"] = func(response_ Any) Any {
+		return readBody(response_, func(data []byte) (Any, error) {
+			return string(data), nil
+		})
+	}
+
+	// json :: Response -> Aff String
+	// The body as it is, for PureScript to parse (see jsonValue)
+	exports["json"] = func(response_ Any) Any {
+		return readBody(response_, func(data []byte) (Any, error) {
+			return string(data), nil
+		})
+	}
+
+	// jsonValue :: Response -> Aff Foreign
+	// The body decoded in Go, as objects, arrays, strings, numbers,
+	// booleans and null
+	exports["jsonValue"] = func(response_ Any) Any {
+		return readBody(response_, func(data []byte) (Any, error) {
+			var value Any
+			if err := json.Unmarshal(data, &value); err != nil {
+				return nil, err
+			}
+			return value, nil
+		})
+	}
+
+	// buffer :: Response -> Aff Buffer
+	exports["buffer"] = func(response_ Any) Any {
+		return readBody(response_, func(data []byte) (Any, error) {
+			return data, nil
+		})
 	}
 
 	// arrayBuffer :: Response -> Aff ArrayBuffer
-	exports["arrayBuffer"] = func(response_ Any) Any {
-		return func(callback_ Any) Any {
-			return func() Any {
-				callback := callback_.(func(Any) Any)
-				response := response_.(Dict)
-				
-				if body, ok := response["body"].(string); ok {
-					Apply(callback, Dict{"Right": []byte(body)})
-				} else {
-					Apply(callback, Dict{"Left": "No body in response"})
-				}
-				
-				return func() Any { return nil }
+	exports["arrayBuffer"] = exports["buffer"]
+
+	// discard :: Response -> Effect Unit
+	// Closes the body of a response that won't be read, releasing its
+	// connection. Reading the body afterwards fails as if it had been read.
+	exports["discard"] = func(response_ Any) Any {
+		return func() Any {
+			response := response_.(Dict)
+			if body, ok := response["_body"].(*responseBody); ok {
+				body.discard()
 			}
+			return nil
+		}
+	}
+
+	// bodyUsed :: Response -> Effect Boolean
+	exports["bodyUsed"] = func(response_ Any) Any {
+		return func() Any {
+			response := response_.(Dict)
+			if body, ok := response["_body"].(*responseBody); ok {
+				return body.isUsed()
+			}
+			return true
 		}
 	}
 
@@ -195,7 +265,7 @@ func init() {
 	exports["header"] = func(name_ Any, response_ Any) Any {
 		name := strings.ToLower(name_.(string))
 		response := response_.(Dict)
-		
+
 		if headers, ok := response["headers"].(Dict); ok {
 			if val, ok := headers[name].(string); ok {
 				return Dict{"value0": val} // Just value
@@ -204,6 +274,15 @@ func init() {
 		return Dict{} // Nothing
 	}
 
+	// redirected :: Response -> Boolean
+	exports["redirected"] = func(response_ Any) Any {
+		response := response_.(Dict)
+		if redirected, ok := response["redirected"].(bool); ok {
+			return redirected
+		}
+		return false
+	}
+
 	// url :: Response -> String
 	exports["url"] = func(response_ Any) Any {
 		response := response_.(Dict)
@@ -213,6 +292,82 @@ func init() {
 		return ""
 	}
 
+	// isRedirect :: Response -> Boolean
+	exports["isRedirect"] = func(response_ Any) Any {
+		status, _ := response_.(Dict)["status"].(int)
+		return status >= 300 && status < 400
+	}
+
+	// isClientError :: Response -> Boolean
+	exports["isClientError"] = func(response_ Any) Any {
+		status, _ := response_.(Dict)["status"].(int)
+		return status >= 400 && status < 500
+	}
+
+	// isServerError :: Response -> Boolean
+	exports["isServerError"] = func(response_ Any) Any {
+		status, _ := response_.(Dict)["status"].(int)
+		return status >= 500 && status < 600
+	}
+
+	// ensureOk :: Response -> Aff Response
+	// Fails with an HTTP error unless the status is 2xx. The error keeps the
+	// first kilobyte of the body, which is read and closed
+	exports["ensureOk"] = func(response_ Any) Any {
+		response := response_.(Dict)
+		if ok, _ := response["ok"].(bool); ok {
+			return aff.MakePure(response)
+		}
+		return aff.MakeGoAsync(func(onError func(Any), onSuccess func(Any)) aff.Canceler {
+			statusText, _ := response["statusText"].(string)
+			data := Dict{"status": response["status"], "statusText": statusText, "headers": response["headers"], "body": ""}
+			httpErr := fetchFailure(NameHTTP, "fetch: HTTP "+statusText, nil)
+			httpErr.Data = data
+
+			body, ok := response["_body"].(*responseBody)
+			if !ok {
+				onError(httpErr)
+				return nonCanceler
+			}
+			go func() {
+				// A body that can't be read doesn't change the error
+				text, _ := body.consumeUpTo(maxErrorBody)
+				data["body"] = string(text)
+				onError(httpErr)
+			}()
+			return aff.ContextCanceler(body.cancel)
+		})
+	}
+
+	// fetchErrorImpl :: FetchErrorConstructors -> Error -> FetchError
+	// Classifies the error a fetch failed with by its name. The constructors
+	// record has timeout, connectionRefused, tls, dns, cancelled, bodyRead
+	// and other, each taking the error message, and http, taking
+	// { status :: Int, statusText :: String, headers :: Headers, body :: String }
+	exports["fetchErrorImpl"] = func(constructors_ Any, err_ Any) Any {
+		constructors := constructors_.(Dict)
+		message := exceptions.Message(err_)
+		switch exceptions.Name(err_) {
+		case NameHTTP:
+			if data, ok := exceptions.Data(err_); ok {
+				return Apply(constructors["http"], data)
+			}
+		case NameTimeout:
+			return Apply(constructors["timeout"], message)
+		case NameConnectionRefused:
+			return Apply(constructors["connectionRefused"], message)
+		case NameTLS:
+			return Apply(constructors["tls"], message)
+		case NameDNS:
+			return Apply(constructors["dns"], message)
+		case NameCancelled:
+			return Apply(constructors["cancelled"], message)
+		case NameBodyRead:
+			return Apply(constructors["bodyRead"], message)
+		}
+		return Apply(constructors["other"], message)
+	}
+
 	// ok :: Response -> Boolean
 	exports["ok"] = func(response_ Any) Any {
 		response := response_.(Dict)
@@ -223,25 +378,614 @@ func init() {
 	}
 }
 
+// fetchRequest creates the Aff that sends a request, calling started with
+// the request before it is sent. It fails with Effect.Exception Errors
+// named for why the request failed
+func fetchRequest(client *Client, url string, options Dict, started func(*http.Request)) Any {
+	return aff.MakeGoAsync(func(onError func(Any), onSuccess func(Any)) aff.Canceler {
+		// The context is cancelled by the Aff canceler or when the timeout expires
+		ctx, cancel := requestContext(options)
+
+		// A response that arrives after the fiber was killed, or just before,
+		// is never read, so the canceler discards its body
+		var delivered struct {
+			sync.Mutex
+			body      *responseBody
+			cancelled bool
+		}
+		canceler := aff.ContextCanceler(func() {
+			delivered.Lock()
+			body := delivered.body
+			delivered.cancelled = true
+			delivered.Unlock()
+			cancel()
+			if body != nil {
+				body.discard()
+			}
+		})
+
+		req, err := buildRequest(ctx, url, options)
+		if err != nil {
+			cancel()
+			onError(fetchFailure(NameFetch, err.Error(), err))
+			return canceler
+		}
+		for key, value := range client.headers {
+			if req.Header.Get(key) == "" {
+				req.Header.Set(key, value)
+			}
+		}
+		started(req)
+
+		// Make request in goroutine
+		go func() {
+			resp, err := client.do(req)
+			if err != nil {
+				err = fetchError(ctx, err)
+				cancel()
+				onError(err)
+				return
+			}
+
+			// Build headers dict
+			respHeaders := make(Dict)
+			for key, values := range resp.Header {
+				respHeaders[strings.ToLower(key)] = strings.Join(values, ", ")
+			}
+
+			body := newResponseBody(ctx, cancel, resp.Body)
+			delivered.Lock()
+			cancelled := delivered.cancelled
+			delivered.body = body
+			delivered.Unlock()
+			if cancelled {
+				body.discard()
+				return
+			}
+
+			// Build response object
+			onSuccess(Dict{
+				"status":     resp.StatusCode,
+				"statusText": resp.Status,
+				"headers":    respHeaders,
+				"_body":      body,
+				"url":        resp.Request.URL.String(),
+				// The client copies the request when it has a timeout, so
+				// only a request made for a redirect has a Response
+				"redirected": resp.Request.Response != nil,
+				"ok":         resp.StatusCode >= 200 && resp.StatusCode < 300,
+			})
+		}()
+
+		return canceler
+	})
+}
+
+// Client is an HTTP client with its own redirect policy, cookies, TLS roots
+// and default headers
+type Client struct {
+	http    *http.Client
+	headers map[string]string
+}
+
+// defaultClient is used by fetch and fetch'
+var defaultClient = &Client{http: http.DefaultClient}
+
+// installedTransport, when set, replaces the transport of every client
+// (see Fetch.Mock)
+var installedTransport struct {
+	sync.RWMutex
+	transport http.RoundTripper
+}
+
+func installTransport(transport http.RoundTripper) {
+	installedTransport.Lock()
+	defer installedTransport.Unlock()
+	installedTransport.transport = transport
+}
+
+// do sends a request with the client, or through the installed transport
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	installedTransport.RLock()
+	transport := installedTransport.transport
+	installedTransport.RUnlock()
+	if transport == nil {
+		return c.http.Do(req)
+	}
+	client := *c.http
+	client.Transport = transport
+	return client.Do(req)
+}
+
+// newClient creates a Client from ClientOptions:
+//
+//   - maxRedirects :: Int, the number of redirects to follow (default 10)
+//   - followRedirects :: Boolean, false returns 3xx responses as they are
+//   - cookieJar :: Boolean, keep cookies between requests
+//   - caBundle :: String, path to a PEM file of trusted root certificates
+//   - proxy :: String, URL of the proxy to use for all requests
+//   - maxConnsPerHost :: Int, limit on connections per host
+//   - timeout :: Number, overall limit in milliseconds for each request
+//   - headers :: Object String, headers sent unless a request sets them
+func newClient(options Dict) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client := &Client{http: &http.Client{Transport: transport}, headers: map[string]string{}}
+
+	maxRedirects := 10
+	if n, ok := options["maxRedirects"].(int); ok {
+		maxRedirects = n
+	}
+	follow := true
+	if f, ok := options["followRedirects"].(bool); ok {
+		follow = f
+	}
+	client.http.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !follow {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+
+	if useJar, ok := options["cookieJar"].(bool); ok && useJar {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		client.http.Jar = jar
+	}
+
+	if path, ok := options["caBundle"].(string); ok {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	if proxy, ok := options["proxy"].(string); ok {
+		proxyURL, err := neturl.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if n, ok := options["maxConnsPerHost"].(int); ok {
+		transport.MaxConnsPerHost = n
+		transport.MaxIdleConnsPerHost = n
+	}
+
+	switch t := options["timeout"].(type) {
+	case float64:
+		client.http.Timeout = time.Duration(t * float64(time.Millisecond))
+	case int:
+		client.http.Timeout = time.Duration(t) * time.Millisecond
+	}
+
+	if headers, ok := options["headers"].(Dict); ok {
+		for key, value := range headers {
+			if val, ok := value.(string); ok {
+				client.headers[key] = val
+			}
+		}
+	}
+
+	return client, nil
+}
+
+func nonCanceler(error Any) Any {
+	return aff.MakeSync(func() Any { return nil })
+}
+
+// requestContext creates the context for a request, honouring the
+// `timeout` option (in milliseconds)
+func requestContext(options Dict) (context.Context, context.CancelFunc) {
+	var timeout time.Duration
+	switch t := options["timeout"].(type) {
+	case float64:
+		timeout = time.Duration(t * float64(time.Millisecond))
+	case int:
+		timeout = time.Duration(t) * time.Millisecond
+	}
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// fetchError converts a request error into the error a fetch fails with,
+// naming it by the underlying Go error, which is kept as the cause. The
+// request context decides whether the request timed out or was cancelled.
+func fetchError(ctx context.Context, err error) *exceptions.Error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fetchFailure(NameTimeout, ErrTimeout.Error(), ErrTimeout)
+	case context.Canceled:
+		return fetchFailure(NameCancelled, ErrCancelled.Error(), ErrCancelled)
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCertificate x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var recordHeader tls.RecordHeaderError
+	switch {
+	case errors.As(err, &dnsErr):
+		return fetchFailure(NameDNS, err.Error(), err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fetchFailure(NameConnectionRefused, err.Error(), err)
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCertificate),
+		errors.As(err, &hostname), errors.As(err, &recordHeader):
+		return fetchFailure(NameTLS, err.Error(), err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fetchFailure(NameTimeout, err.Error(), timedOut{err})
+	}
+	return fetchFailure(NameFetch, err.Error(), err)
+}
+
+// timedOut wraps a network timeout so that errors.Is matches ErrTimeout,
+// as when the timeout option expires, as well as the error itself
+type timedOut struct {
+	err error
+}
+
+func (e timedOut) Error() string { return e.err.Error() }
+
+func (e timedOut) Unwrap() error { return e.err }
+
+func (e timedOut) Is(target error) bool { return target == ErrTimeout }
+
+// bodyError converts an error reading a response body into the error a
+// fetch fails with
+func bodyError(ctx context.Context, err error) *exceptions.Error {
+	e := fetchError(ctx, err)
+	if e.Name != NameTimeout && e.Name != NameCancelled {
+		e.Name = NameBodyRead
+	}
+	return e
+}
+
+// retryPolicy controls how retrying replays a request. It is built from a
+// RetryPolicy record:
+//
+//   - maxRetries :: Int, retries after the first attempt (default 3)
+//   - retryOn :: Array Int, statuses to retry (default 429, 502, 503, 504)
+//   - retryNetworkErrors :: Boolean, retry failed requests (default true)
+//   - baseDelay :: Number, milliseconds before the first retry (default 100)
+//   - maxDelay :: Number, upper bound on any delay in milliseconds (default 10000)
+//   - jitter :: Boolean, randomise delays between half and all of the backoff (default true)
+//   - retryNonIdempotent :: Boolean, also replay POST and PATCH requests
+//     without a buffered body (default false)
+type retryPolicy struct {
+	maxRetries    int
+	retryOn       map[int]bool
+	networkErrors bool
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	jitter        bool
+	nonIdempotent bool
+}
+
+func newRetryPolicy(options Dict) retryPolicy {
+	policy := retryPolicy{
+		maxRetries:    3,
+		retryOn:       map[int]bool{429: true, 502: true, 503: true, 504: true},
+		networkErrors: true,
+		baseDelay:     100 * time.Millisecond,
+		maxDelay:      10 * time.Second,
+		jitter:        true,
+	}
+	if n, ok := options["maxRetries"].(int); ok {
+		policy.maxRetries = n
+	}
+	if statuses, ok := options["retryOn"].([]Any); ok {
+		policy.retryOn = map[int]bool{}
+		for _, status := range statuses {
+			if code, ok := status.(int); ok {
+				policy.retryOn[code] = true
+			}
+		}
+	}
+	if b, ok := options["retryNetworkErrors"].(bool); ok {
+		policy.networkErrors = b
+	}
+	if ms, ok := options["baseDelay"].(float64); ok {
+		policy.baseDelay = time.Duration(ms * float64(time.Millisecond))
+	}
+	if ms, ok := options["maxDelay"].(float64); ok {
+		policy.maxDelay = time.Duration(ms * float64(time.Millisecond))
+	}
+	if b, ok := options["jitter"].(bool); ok {
+		policy.jitter = b
+	}
+	if b, ok := options["retryNonIdempotent"].(bool); ok {
+		policy.nonIdempotent = b
+	}
+	return policy
+}
+
+// backoff is the delay before a retry: exponential in the number of
+// retries so far, capped at maxDelay, with optional jitter
+func (p retryPolicy) backoff(retry int) time.Duration {
+	// Shifting is only safe while the result stays under maxDelay
+	delay := p.maxDelay
+	if retry < 63 && p.baseDelay <= p.maxDelay>>uint(retry) {
+		delay = p.baseDelay << uint(retry)
+	}
+	if p.jitter && delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+	}
+	return delay
+}
+
+// retryAfter reads the Retry-After header of a response, given either in
+// seconds or as an HTTP date
+func retryAfter(response Dict) (time.Duration, bool) {
+	headers, _ := response["headers"].(Dict)
+	value, ok := headers["retry-after"].(string)
+	if !ok {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryScope records the requests started by one attempt of the Aff passed
+// to retrying. It is bound in the attempt's fiber locals, so concurrent
+// retryings never see each other's requests.
+type retryScope struct {
+	allowNonIdempotent bool
+
+	mu         sync.Mutex
+	recorded   bool
+	replayable bool
+}
+
+// retryScopeKey binds the scope of the innermost retrying
+var retryScopeKey = aff.NewLocalKey("retryScope")
+
+// record notes whether a request can be replayed (see replayable)
+func (s *retryScope) record(req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := replayable(req, s.allowNonIdempotent)
+	s.replayable = ok && (s.replayable || !s.recorded)
+	s.recorded = true
+}
+
+// canReplay is true unless a recorded request can't be replayed. An Aff that
+// doesn't go through fetch is assumed to be safe to run again.
+func (s *retryScope) canReplay() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.recorded || s.replayable
+}
+
+// replayable is the rule for which requests retrying may send again:
+// idempotent requests and requests whose body is a buffer that can be sent
+// again, or any request if the policy allows it. A body that can't be sent
+// again is never replayed.
+func replayable(req *http.Request, allowNonIdempotent bool) bool {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		return false
+	}
+	if hasBody {
+		return true
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return allowNonIdempotent
+}
+
+// retryResult is the outcome of one attempt
+type retryResult struct {
+	response Any
+	err      Any
+	failed   bool
+}
+
+// retrying runs request, replaying it with backoff while the policy allows
+func retrying(policy retryPolicy, request Any, retry int) Any {
+	scope := &retryScope{allowNonIdempotent: policy.nonIdempotent}
+	attempt := aff.MakeCatch(
+		aff.MakeBind(aff.WithLocal(retryScopeKey, scope, request), func(response Any) Any {
+			return aff.MakePure(retryResult{response: response})
+		}),
+		func(err Any) Any {
+			return aff.MakePure(retryResult{err: err, failed: true})
+		},
+	)
+
+	return aff.MakeBind(attempt, func(result_ Any) Any {
+		result := result_.(retryResult)
+		again := func(delay time.Duration) Any {
+			return aff.MakeBind(aff.Delay(delay), func(Any) Any {
+				return retrying(policy, request, retry+1)
+			})
+		}
+		canRetry := retry < policy.maxRetries && scope.canReplay()
+
+		if result.failed {
+			err, _ := result.err.(error)
+			if canRetry && policy.networkErrors && !errors.Is(err, ErrCancelled) {
+				return again(policy.backoff(retry))
+			}
+			return aff.MakeThrow(result.err)
+		}
+
+		response, ok := result.response.(Dict)
+		status, _ := response["status"].(int)
+		if !ok || !canRetry || !policy.retryOn[status] {
+			return aff.MakePure(result.response)
+		}
+		if body, ok := response["_body"].(*responseBody); ok {
+			body.discard()
+		}
+		delay := policy.backoff(retry)
+		if after, ok := retryAfter(response); ok {
+			delay = after
+			if delay > policy.maxDelay {
+				delay = policy.maxDelay
+			}
+		}
+		return again(delay)
+	})
+}
+
+// responseBody is the unread body of a response. It can be consumed once;
+// the request context is released when it has been read
+type responseBody struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	body io.ReadCloser
+	used bool
+}
+
+// newResponseBody wraps the body of a response. Bodies are released when
+// they are read, streamed and closed, or discarded: explicitly, by retrying,
+// or when the fiber that fetched them is killed. A response that is simply
+// dropped is discarded when it is garbage collected, as a last resort, so
+// the request context and the connection aren't held forever.
+func newResponseBody(ctx context.Context, cancel context.CancelFunc, body io.ReadCloser) *responseBody {
+	b := &responseBody{ctx: ctx, cancel: cancel, body: body}
+	runtime.SetFinalizer(b, func(b *responseBody) {
+		// Nothing can read the body any more, even a stream that was started
+		b.body.Close()
+		b.cancel()
+	})
+	return b
+}
+
+func (b *responseBody) isUsed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// consume reads the whole body, failing if it has already been read
+func (b *responseBody) consume() ([]byte, error) {
+	return b.consumeUpTo(-1)
+}
+
+// consumeUpTo reads at most limit bytes of the body, or all of it when limit
+// is negative, and closes it
+func (b *responseBody) consumeUpTo(limit int64) ([]byte, error) {
+	b.mu.Lock()
+	if b.used {
+		b.mu.Unlock()
+		return nil, fetchFailure(NameBodyRead, ErrBodyUsed.Error(), ErrBodyUsed)
+	}
+	b.used = true
+	b.mu.Unlock()
+
+	defer b.cancel()
+	defer b.body.Close()
+	var reader io.Reader = b.body
+	if limit >= 0 {
+		reader = io.LimitReader(b.body, limit)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, bodyError(b.ctx, err)
+	}
+	return data, nil
+}
+
+// claim marks the body as used by a stream
+func (b *responseBody) claim() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used {
+		return fetchFailure(NameBodyRead, ErrBodyUsed.Error(), ErrBodyUsed)
+	}
+	b.used = true
+	return nil
+}
+
+// stream reads a claimed body in chunks. Closing the stream cancels the
+// request, which releases the connection and interrupts a pending read
+func (b *responseBody) stream() *Stream {
+	return newStream(func() (Any, error) {
+		chunk := make([]byte, streamChunkSize)
+		n, err := b.body.Read(chunk)
+		for n == 0 && err == nil {
+			n, err = b.body.Read(chunk)
+		}
+		if n > 0 {
+			return chunk[:n], nil
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, bodyError(b.ctx, err)
+	}, func() {
+		b.cancel()
+		b.body.Close()
+	})
+}
+
+// discard closes the body of a response that won't be read
+func (b *responseBody) discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.used {
+		b.used = true
+		b.body.Close()
+		b.cancel()
+	}
+}
+
 // Helper function to build request with options
-func buildRequest(url string, options Dict) (*http.Request, error) {
+//
+// The body is taken from `body` (a String or a Buffer) or from `form`
+// (an Object of String or Array String values), which is URL-encoded
+func buildRequest(ctx context.Context, url string, options Dict) (*http.Request, error) {
 	method := "GET"
 	if m, ok := options["method"].(string); ok {
 		method = strings.ToUpper(m)
 	}
-	
+
 	var body io.Reader
+	contentType := ""
 	if b, ok := options["body"].(string); ok {
-		body = bytes.NewBufferString(b)
+		body = strings.NewReader(b)
 	} else if b, ok := options["body"].([]byte); ok {
-		body = bytes.NewBuffer(b)
+		// bytes.Reader lets net/http set Content-Length and replay the body
+		body = bytes.NewReader(b)
+	} else if form, ok := options["form"].(Dict); ok {
+		body = strings.NewReader(encodeForm(form))
+		contentType = "application/x-www-form-urlencoded"
 	}
-	
-	req, err := http.NewRequest(method, url, body)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
-	
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
 	// Set headers
 	if headers, ok := options["headers"].(Dict); ok {
 		for key, value := range headers {
@@ -250,7 +994,24 @@ func buildRequest(url string, options Dict) (*http.Request, error) {
 			}
 		}
 	}
-	
+
 	return req, nil
 }
 
+// encodeForm URL-encodes a form record
+func encodeForm(form Dict) string {
+	values := neturl.Values{}
+	for key, value := range form {
+		switch v := value.(type) {
+		case string:
+			values.Add(key, v)
+		case []Any:
+			for _, item := range v {
+				if str, ok := item.(string); ok {
+					values.Add(key, str)
+				}
+			}
+		}
+	}
+	return values.Encode()
+}
@@ -0,0 +1,314 @@
+package purescript_fetch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
+	. "github.com/purescript-native/go-runtime"
+)
+
+func init() {
+	exports := exceptions.RegisterExports("Fetch.Mock")
+
+	// newMock :: Effect Mock
+	exports["newMock"] = func() Any {
+		return &Mock{}
+	}
+
+	// stub :: Mock -> Matcher -> MockResponse -> Effect Unit
+	// Matcher is { method :: String, url :: String, body :: String }, where
+	// url and body are regular expressions; missing fields match anything
+	exports["stub"] = func(mock_ Any, matcher_ Any, response_ Any) Any {
+		return func() Any {
+			mock := mock_.(*Mock)
+			matcher := matcher_.(Dict)
+			response := response_.(Dict)
+			s, err := newStub(matcher, response)
+			if err != nil {
+				panic(exceptions.Errorf("Invalid stub: %w", err))
+			}
+			mock.add(s)
+			return nil
+		}
+	}
+
+	// replayFrom :: String -> Effect Mock
+	// Creates a mock serving the interactions of a cassette file, in order
+	exports["replayFrom"] = func(path_ Any) Any {
+		return func() Any {
+			path := path_.(string)
+			mock, err := replayFrom(path)
+			if err != nil {
+				panic(exceptions.Errorf("Failed to load cassette: %w", err))
+			}
+			return mock
+		}
+	}
+
+	// recordTo :: String -> Effect Mock
+	// Creates a mock that sends requests over the network and saves every
+	// interaction to a cassette file
+	exports["recordTo"] = func(path_ Any) Any {
+		return func() Any {
+			path := path_.(string)
+			return &Mock{cassette: path, upstream: http.DefaultTransport}
+		}
+	}
+
+	// install :: Mock -> Effect Unit
+	// All fetches go through the mock until uninstall is called
+	exports["install"] = func(mock_ Any) Any {
+		return func() Any {
+			mock := mock_.(*Mock)
+			installTransport(mock)
+			return nil
+		}
+	}
+
+	// uninstall :: Effect Unit
+	exports["uninstall"] = func() Any {
+		installTransport(nil)
+		return nil
+	}
+
+	// unmatched :: Mock -> Effect (Array { method :: String, url :: String, body :: String })
+	exports["unmatched"] = func(mock_ Any) Any {
+		return func() Any {
+			mock := mock_.(*Mock)
+			mock.mu.Lock()
+			defer mock.mu.Unlock()
+			requests := make([]Any, len(mock.unmatched))
+			for i, req := range mock.unmatched {
+				requests[i] = Dict{"method": req.Method, "url": req.URL, "body": req.Body}
+			}
+			return requests
+		}
+	}
+}
+
+// Mock is an http.RoundTripper that answers requests from stubs, or
+// records real interactions when created with recordTo
+type Mock struct {
+	mu        sync.Mutex
+	stubs     []*stub
+	unmatched []recordedRequest
+
+	// Recording mode
+	cassette     string
+	upstream     http.RoundTripper
+	interactions []interaction
+}
+
+// stub is a canned response for matching requests. Stubs loaded from a
+// cassette answer a single request each
+type stub struct {
+	method   string
+	url      *regexp.Regexp
+	body     *regexp.Regexp
+	response recordedResponse
+	once     bool
+	used     bool
+}
+
+// interaction is one request and its response, as saved in a cassette
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	BodyBase64 string            `json:"bodyBase64,omitempty"`
+}
+
+func newStub(matcher Dict, response Dict) (*stub, error) {
+	s := &stub{response: recordedResponse{Status: 200, Headers: map[string]string{}}}
+	if method, ok := matcher["method"].(string); ok {
+		s.method = strings.ToUpper(method)
+	}
+	if pattern, ok := matcher["url"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.url = re
+	}
+	if pattern, ok := matcher["body"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.body = re
+	}
+	if status, ok := response["status"].(int); ok {
+		s.response.Status = status
+	}
+	if headers, ok := response["headers"].(Dict); ok {
+		for key, value := range headers {
+			if val, ok := value.(string); ok {
+				s.response.Headers[key] = val
+			}
+		}
+	}
+	switch body := response["body"].(type) {
+	case string:
+		s.response.Body = body
+	case []byte:
+		s.response.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	return s, nil
+}
+
+// replayFrom loads a cassette, with one exact stub per interaction
+func replayFrom(path string) (*Mock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var interactions []interaction
+	if err := json.Unmarshal(data, &interactions); err != nil {
+		return nil, err
+	}
+	mock := &Mock{}
+	for _, i := range interactions {
+		mock.add(&stub{
+			method:   i.Request.Method,
+			url:      regexp.MustCompile("^" + regexp.QuoteMeta(i.Request.URL) + "$"),
+			body:     regexp.MustCompile("^" + regexp.QuoteMeta(i.Request.Body) + "$"),
+			response: i.Response,
+			once:     true,
+		})
+	}
+	return mock, nil
+}
+
+func (m *Mock) add(s *stub) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stubs = append(m.stubs, s)
+}
+
+func (s *stub) matches(req recordedRequest) bool {
+	if s.used {
+		return false
+	}
+	if s.method != "" && s.method != req.Method {
+		return false
+	}
+	if s.url != nil && !s.url.MatchString(req.URL) {
+		return false
+	}
+	if s.body != nil && !s.body.MatchString(req.Body) {
+		return false
+	}
+	return true
+}
+
+// RoundTrip answers a request from the first matching stub. In recording
+// mode the request is sent upstream and the interaction saved instead
+func (m *Mock) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded := recordedRequest{Method: req.Method, URL: req.URL.String()}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		recorded.Body = string(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if m.upstream != nil {
+		return m.record(req, recorded)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.stubs {
+		if s.matches(recorded) {
+			s.used = s.once
+			return s.response.toHTTP(req)
+		}
+	}
+	m.unmatched = append(m.unmatched, recorded)
+	return nil, fmt.Errorf("fetch mock: no stub matches %s %s", recorded.Method, recorded.URL)
+}
+
+// record sends a request upstream and appends the interaction to the cassette
+func (m *Mock) record(req *http.Request, recorded recordedRequest) (*http.Response, error) {
+	resp, err := m.upstream.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	response := recordedResponse{Status: resp.StatusCode, Headers: map[string]string{}}
+	for key, values := range resp.Header {
+		response.Headers[key] = strings.Join(values, ", ")
+	}
+	if utf8.Valid(body) {
+		response.Body = string(body)
+	} else {
+		response.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.interactions = append(m.interactions, interaction{Request: recorded, Response: response})
+	data, err := json.MarshalIndent(m.interactions, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(m.cassette, data, 0644); err != nil {
+		return nil, err
+	}
+	return response.toHTTP(req)
+}
+
+func (r recordedResponse) toHTTP(req *http.Request) (*http.Response, error) {
+	body := []byte(r.Body)
+	if r.BodyBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(r.BodyBase64)
+		if err != nil {
+			return nil, err
+		}
+		body = decoded
+	}
+	header := http.Header{}
+	for key, value := range r.Headers {
+		header.Set(key, value)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package purescript_fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+func installMock(t *testing.T, mock Any) {
+	exports := Foreign("Fetch.Mock")
+	Run(exports["install"].(func(Any) Any)(mock))
+	t.Cleanup(func() { Run(exports["uninstall"]) })
+}
+
+func TestMockStubs(t *testing.T) {
+	exports := Foreign("Fetch.Mock")
+	stub := exports["stub"].(func(Any, Any, Any) Any)
+	unmatched := exports["unmatched"].(func(Any) Any)
+
+	mock := Run(exports["newMock"])
+	Run(stub(mock,
+		Dict{"method": "get", "url": `^https://api\.example\.com/users/\d+$`},
+		Dict{"status": 200, "headers": Dict{"Content-Type": "application/json"}, "body": `{"id":1}`}))
+	Run(stub(mock,
+		Dict{"method": "POST", "url": "/users$", "body": `"name":"ada"`},
+		Dict{"status": 201}))
+	installMock(t, mock)
+
+	response := fetchResponse(t, "https://api.example.com/users/1", Dict{})
+	if response["status"] != 200 {
+		t.Errorf("Expected stubbed 200, got %v", response["status"])
+	}
+	if text := readResponse(t, "text", response); text != (either{value: `{"id":1}`}) {
+		t.Errorf("Expected stubbed body, got %v", text)
+	}
+
+	created := fetchResponse(t, "https://api.example.com/users", Dict{"method": "POST", "body": `{"name":"ada"}`})
+	if created["status"] != 201 {
+		t.Errorf("Expected stubbed 201, got %v", created["status"])
+	}
+
+	// Requests without a stub fail and are recorded
+	if result := fetchResult(t, "https://api.example.com/users", Dict{"method": "POST", "body": `{"name":"bob"}`}); !result.isLeft {
+		t.Error("Expected an unmatched request to fail")
+	}
+	calls := Run(unmatched(mock)).([]Any)
+	if len(calls) != 1 || calls[0].(Dict)["body"] != `{"name":"bob"}` {
+		t.Errorf("Expected the unmatched POST to be recorded, got %v", calls)
+	}
+}
+
+func TestMockRecordReplay(t *testing.T) {
+	exports := Foreign("Fetch.Mock")
+	recordTo := exports["recordTo"].(func(Any) Any)
+	replayFrom := exports["replayFrom"].(func(Any) Any)
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("X-Hit", "yes")
+		w.Write([]byte(r.URL.Path))
+	}))
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	// Record two interactions against the real server
+	installMock(t, Run(recordTo(cassette)))
+	fetchResponse(t, server.URL+"/one", Dict{})
+	fetchResponse(t, server.URL+"/two", Dict{})
+	server.Close()
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("Expected 2 recorded requests, got %d", n)
+	}
+
+	// Replay them with the server gone
+	installMock(t, Run(replayFrom(cassette)))
+	response := fetchResponse(t, server.URL+"/two", Dict{})
+	if text := readResponse(t, "text", response); text != (either{value: "/two"}) {
+		t.Errorf("Expected replayed body '/two', got %v", text)
+	}
+	if headers := response["headers"].(Dict); headers["x-hit"] != "yes" {
+		t.Errorf("Expected replayed headers, got %v", headers)
+	}
+	fetchResponse(t, server.URL+"/one", Dict{})
+
+	// Each interaction is replayed once
+	if result := fetchResult(t, server.URL+"/one", Dict{}); !result.isLeft {
+		t.Error("Expected a replayed interaction to be used only once")
+	}
+}
@@ -0,0 +1,148 @@
+package purescript_fetch
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
+	. "github.com/purescript-native/go-runtime"
+)
+
+// streamChunkSize is the largest Buffer read from a body stream at once
+const streamChunkSize = 32 * 1024
+
+func init() {
+	exports := Foreign("Fetch.Stream")
+
+	// read :: forall a. Stream a -> Aff (Maybe a)
+	// Waits for the next value, or Nothing at the end of the stream. Killing
+	// the fiber while it waits closes the stream
+	exports["read"] = func(stream_ Any) Any {
+		stream := stream_.(*Stream)
+		return aff.MakeGoAsync(func(onError func(Any), onSuccess func(Any)) aff.Canceler {
+			go func() {
+				value, ok, err := stream.pull()
+				switch {
+				case err != nil:
+					onError(err)
+				case ok:
+					onSuccess(Dict{"value0": value}) // Just value
+				default:
+					onSuccess(Dict{}) // Nothing
+				}
+			}()
+			return func(error Any) Any {
+				return aff.MakeSync(func() Any {
+					stream.Close()
+					return nil
+				})
+			}
+		})
+	}
+
+	// close :: forall a. Stream a -> Effect Unit
+	// Stops reading; the connection is released and later reads return Nothing
+	exports["close"] = func(stream_ Any) Any {
+		return func() Any {
+			stream := stream_.(*Stream)
+			stream.Close()
+			return nil
+		}
+	}
+
+	// lines :: Stream Buffer -> Stream String
+	// Splits a stream of Buffers into lines, without their line endings
+	exports["lines"] = func(stream_ Any) Any {
+		stream := stream_.(*Stream)
+		return lines(stream)
+	}
+}
+
+// Stream is a pull-based source of values, such as the chunks of a
+// response body. Values are produced one at a time by read
+type Stream struct {
+	mu   sync.Mutex // held while pulling a value
+	next func() (Any, error)
+	done bool
+
+	closeOnce sync.Once
+	closeMu   sync.Mutex
+	closed    bool
+	release   func()
+}
+
+// newStream creates a Stream from next, which returns io.EOF at the end,
+// and release, which is called once when the stream ends or is closed
+func newStream(next func() (Any, error), release func()) *Stream {
+	return &Stream{next: next, release: release}
+}
+
+// pull produces the next value, with ok false at the end of the stream
+func (s *Stream) pull() (value Any, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done || s.isClosed() {
+		return nil, false, nil
+	}
+	value, err = s.next()
+	if err != nil {
+		s.done = true
+		// Reads interrupted by Close end the stream quietly
+		interrupted := s.isClosed()
+		s.Close()
+		if err == io.EOF || interrupted {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *Stream) isClosed() bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	return s.closed
+}
+
+// Close releases the stream. It may be called while a pull is waiting
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		s.closeMu.Lock()
+		s.closed = true
+		s.closeMu.Unlock()
+		s.release()
+	})
+}
+
+// lines splits a stream of Buffers at "\n", dropping a trailing "\r"
+func lines(source *Stream) *Stream {
+	var pending []byte
+	sourceDone := false
+	return newStream(func() (Any, error) {
+		for {
+			if i := bytes.IndexByte(pending, '\n'); i >= 0 {
+				line := pending[:i]
+				pending = pending[i+1:]
+				return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+			}
+			if sourceDone {
+				if len(pending) == 0 {
+					return nil, io.EOF
+				}
+				line := pending
+				pending = nil
+				return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+			}
+			chunk, ok, err := source.pull()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				sourceDone = true
+				continue
+			}
+			pending = append(pending, chunk.([]byte)...)
+		}
+	}, source.Close)
+}
@@ -0,0 +1,86 @@
+package purescript_fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/purescript-native/go-runtime"
+)
+
+// openStream fetches url and returns its body as a Stream
+func openStream(t *testing.T, url string) Any {
+	t.Helper()
+	bodyStream := Foreign("Fetch")["bodyStream"].(func(Any) Any)
+	result := runAff(t, bodyStream(fetchResponse(t, url, Dict{})))
+	if result.isLeft {
+		t.Fatalf("Expected a Stream, got %v", result)
+	}
+	return result.value
+}
+
+func TestStreamLines(t *testing.T) {
+	next := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{\"n\":1}\r\n{\"n\""))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte(":2}\n{\"n\":3}"))
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch.Stream")
+	read := exports["read"].(func(Any) Any)
+	lines := exports["lines"].(func(Any) Any)(openStream(t, server.URL))
+
+	// The first line arrives before the server has finished responding
+	if line := runAff(t, read(lines)); line.value.(Dict)["value0"] != `{"n":1}` {
+		t.Fatalf("Expected the first line, got %v", line)
+	}
+	close(next)
+	for _, expected := range []string{`{"n":2}`, `{"n":3}`} {
+		if line := runAff(t, read(lines)); line.value.(Dict)["value0"] != expected {
+			t.Errorf("Expected %s, got %v", expected, line)
+		}
+	}
+	if end := runAff(t, read(lines)); len(end.value.(Dict)) != 0 {
+		t.Errorf("Expected Nothing at the end of the stream, got %v", end)
+	}
+}
+
+func TestStreamReleasedOnKill(t *testing.T) {
+	disconnected := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: first\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(disconnected)
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch.Stream")
+	read := exports["read"].(func(Any) Any)
+	stream := openStream(t, server.URL)
+	runAff(t, read(stream))
+
+	// Kill the fiber while it waits for more data
+	fiber, _ := launchAff(read(stream))
+	killed := make(chan either, 1)
+	Run(fiber["kill"].(func(Any, Any) Any)(ErrCancelled, func(result Any) Any {
+		return func() Any {
+			killed <- result.(either)
+			return nil
+		}
+	}))
+	awaitResult(t, killed)
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to be released")
+	}
+	if end := runAff(t, read(stream)); end.isLeft || len(end.value.(Dict)) != 0 {
+		t.Errorf("Expected Nothing after the stream was closed, got %v", end)
+	}
+}
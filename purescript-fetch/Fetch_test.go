@@ -0,0 +1,802 @@
+package purescript_fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
+	_ "github.com/i-am-the-slime/go-ffi/purescript-effect"
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
+	. "github.com/purescript-native/go-runtime"
+)
+
+// either is the Either built by the test util. It is deliberately not a
+// Dict, so FFI code can only produce results through the fiber's util
+type either struct {
+	isLeft bool
+	value  Any
+}
+
+// Test utility functions
+func makeUtil() Dict {
+	return Dict{
+		"isLeft": func(e Any) Any {
+			return e.(either).isLeft
+		},
+		"fromLeft": func(e Any) Any {
+			return e.(either).value
+		},
+		"fromRight": func(e Any) Any {
+			return e.(either).value
+		},
+		"left": func(e Any) Any {
+			return either{isLeft: true, value: e}
+		},
+		"right": func(v Any) Any {
+			return either{value: v}
+		},
+	}
+}
+
+// launchAff starts an Aff in a new fiber, as launchAff does, and returns
+// the fiber with a channel receiving its result
+func launchAff(a Any) (Dict, chan either) {
+	makeFiber := Foreign("Effect.Aff")["_makeFiber"].(func(Any, Any) Any)
+	fiber := Run(makeFiber(makeUtil(), a)).(Dict)
+	results := make(chan either, 1)
+	// join runs the suspended fiber
+	join := fiber["join"].(func(Any) Any)
+	Run(join(func(result Any) func() Any {
+		return func() Any {
+			results <- result.(either)
+			return nil
+		}
+	}))
+	return fiber, results
+}
+
+// awaitResult drains the effect queue until a fiber has completed
+func awaitResult(t *testing.T, results chan either) either {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		aff.DrainEffectQueue()
+		select {
+		case result := <-results:
+			return result
+		case <-deadline:
+			t.Fatal("Aff did not complete")
+			return either{}
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// runAff runs an Aff in a fiber, draining the effect queue until it completes
+func runAff(t *testing.T, a Any) either {
+	t.Helper()
+	_, results := launchAff(a)
+	return awaitResult(t, results)
+}
+
+// fetchResult runs a fetch' to completion
+func fetchResult(t *testing.T, url string, options Dict) either {
+	t.Helper()
+	fetch_ := Foreign("Fetch")["fetch'"].(func(Any, Any) Any)
+	return runAff(t, fetch_(url, options))
+}
+
+// fetchResponse runs a fetch' and returns the Response it succeeds with
+func fetchResponse(t *testing.T, url string, options Dict) Dict {
+	t.Helper()
+	result := fetchResult(t, url, options)
+	response, ok := result.value.(Dict)
+	if result.isLeft || !ok {
+		t.Fatalf("Expected a Response, got %v", result)
+	}
+	return response
+}
+
+// readResponse runs one of the body readers (text, json, buffer) on a Response
+func readResponse(t *testing.T, reader string, response Dict) either {
+	t.Helper()
+	read := Foreign("Fetch")[reader].(func(Any) Any)
+	return runAff(t, read(response))
+}
+
+func slowServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("too late"))
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	response := fetchResponse(t, server.URL, Dict{"timeout": 1000.0})
+	text := readResponse(t, "text", response)
+	if text != (either{value: "hello"}) {
+		t.Errorf("Expected body 'hello', got %v", text)
+	}
+}
+
+func TestFetchErrorMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chained"))
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch := exports["fetch"].(func(Any) Any)
+	text := exports["text"].(func(Any) Any)
+
+	// fetch and read the body in a single fiber
+	result := runAff(t, aff.MakeBind(fetch(server.URL), text))
+	if result != (either{value: "chained"}) {
+		t.Errorf("Expected body 'chained', got %v", result)
+	}
+
+	// Failures are Errors that Effect.Exception can read
+	server.Close()
+	result = runAff(t, fetch(server.URL))
+	message := Foreign("Effect.Exception")["message"].(func(Any) Any)
+	if !result.isLeft || message(result.value) == "" {
+		t.Errorf("Expected an Error, got %v", result)
+	}
+}
+
+func TestBodyConsumedOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"go","tags":["a","b"]}`))
+	}))
+	defer server.Close()
+
+	response := fetchResponse(t, server.URL, Dict{})
+	bodyUsed := Foreign("Fetch")["bodyUsed"].(func(Any) Any)
+	if Run(bodyUsed(response)) != false {
+		t.Fatal("Body should not be used before reading")
+	}
+
+	result := readResponse(t, "jsonValue", response)
+	value, ok := result.value.(Dict)
+	if result.isLeft || !ok || value["name"] != "go" || len(value["tags"].([]Any)) != 2 {
+		t.Fatalf("Expected parsed JSON, got %v", result)
+	}
+
+	if Run(bodyUsed(response)) != true {
+		t.Error("Body should be used after reading")
+	}
+	again := readResponse(t, "text", response)
+	if err, ok := again.value.(error); !again.isLeft || !ok || !errors.Is(err, ErrBodyUsed) {
+		t.Errorf("Expected body used error, got %v", again)
+	}
+}
+
+func TestJSONBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"go"}`))
+	}))
+	defer server.Close()
+
+	// json leaves parsing to PureScript
+	result := readResponse(t, "json", fetchResponse(t, server.URL, Dict{}))
+	if result != (either{value: `{"name":"go"}`}) {
+		t.Errorf("Expected the JSON text, got %v", result)
+	}
+}
+
+// closeRecorder is a body that records being closed
+type closeRecorder struct {
+	io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newCloseRecorder(text string) *closeRecorder {
+	return &closeRecorder{Reader: strings.NewReader(text), closed: make(chan struct{})}
+}
+
+func (c *closeRecorder) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// awaitClosed waits for a body to be closed
+func (c *closeRecorder) awaitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the unread body to be closed")
+	}
+}
+
+// transportFunc is an http.RoundTripper made from a function
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDiscard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	body := newCloseRecorder("never read")
+	response := Dict{"_body": newResponseBody(ctx, cancel, body)}
+
+	exports := Foreign("Fetch")
+	Run(exports["discard"].(func(Any) Any)(response))
+	body.awaitClosed(t)
+	if ctx.Err() == nil {
+		t.Error("Expected the request context to be cancelled")
+	}
+	if Run(exports["bodyUsed"].(func(Any) Any)(response)) != true {
+		t.Error("Expected a discarded body to be used")
+	}
+	result := readResponse(t, "text", response)
+	if err, ok := result.value.(error); !result.isLeft || !ok || !errors.Is(err, ErrBodyUsed) {
+		t.Errorf("Expected body used error, got %v", result)
+	}
+}
+
+// Killing the fiber that fetched a response, before or after the response
+// arrives, discards the response's body
+func TestKilledFetchReleasesBody(t *testing.T) {
+	defer installTransport(nil)
+	for _, arrived := range []bool{false, true} {
+		body := newCloseRecorder("never read")
+		sent := make(chan struct{})
+		respond := make(chan struct{})
+		installTransport(transportFunc(func(req *http.Request) (*http.Response, error) {
+			close(sent)
+			<-respond
+			return &http.Response{StatusCode: 200, Status: "200 OK", Header: http.Header{}, Body: body, Request: req}, nil
+		}))
+
+		fetch := Foreign("Fetch")["fetch"].(func(Any) Any)
+		fiber, _ := launchAff(fetch("http://example.com"))
+		<-sent
+		if arrived {
+			close(respond)
+		}
+		killed := make(chan either, 1)
+		Run(fiber["kill"].(func(Any, Any) Any)(ErrCancelled, func(result Any) Any {
+			return func() Any {
+				killed <- result.(either)
+				return nil
+			}
+		}))
+		awaitResult(t, killed)
+		if !arrived {
+			close(respond)
+		}
+		body.awaitClosed(t)
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	var contentLength int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentLength = r.ContentLength
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	payload := []byte{0, 1, 2, 255, 254, 0}
+	response := fetchResponse(t, server.URL, Dict{"method": "put", "body": payload})
+
+	if contentLength != int64(len(payload)) {
+		t.Errorf("Expected Content-Length %d, got %d", len(payload), contentLength)
+	}
+	result := readResponse(t, "buffer", response)
+	if data, ok := result.value.([]byte); result.isLeft || !ok || !bytes.Equal(data, payload) {
+		t.Errorf("Expected echoed payload, got %v", result)
+	}
+}
+
+func TestFormBody(t *testing.T) {
+	var form url.Values
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		r.ParseForm()
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	fetchResponse(t, server.URL, Dict{
+		"method": "POST",
+		"form":   Dict{"name": "a b&c", "tag": []Any{"x", "y"}},
+	})
+
+	if contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("Expected form content type, got %s", contentType)
+	}
+	if form.Get("name") != "a b&c" || len(form["tag"]) != 2 {
+		t.Errorf("Unexpected form values %v", form)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	server := slowServer(time.Second)
+	defer server.Close()
+
+	result := fetchResult(t, server.URL, Dict{"timeout": 20.0})
+	if err, ok := result.value.(error); !result.isLeft || !ok || !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected timeout error, got %v", result)
+	}
+	if name := exceptions.Name(result.value); name != NameTimeout {
+		t.Errorf("Expected a %s, got %s", NameTimeout, name)
+	}
+}
+
+func TestFetchCancel(t *testing.T) {
+	disconnected := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(disconnected)
+	}))
+	defer server.Close()
+
+	fetch := Foreign("Fetch")["fetch"].(func(Any) Any)
+	fiber, results := launchAff(fetch(server.URL))
+	time.Sleep(20 * time.Millisecond)
+
+	// Killing the fiber runs the fetch canceler
+	killed := make(chan either, 1)
+	kill := fiber["kill"].(func(Any, Any) Any)
+	Run(kill(ErrCancelled, func(result Any) Any {
+		return func() Any {
+			killed <- result.(either)
+			return nil
+		}
+	}))
+	awaitResult(t, killed)
+	if result := awaitResult(t, results); !result.isLeft {
+		t.Errorf("Expected the killed fiber to fail, got %v", result)
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Error("Expected the request to be aborted")
+	}
+}
+
+// classify runs fetchErrorImpl with constructors that describe the error
+func classify(err Any) string {
+	tagged := func(tag string) Any {
+		return func(message Any) Any { return tag }
+	}
+	constructors := Dict{
+		"timeout":           tagged("timeout"),
+		"connectionRefused": tagged("connectionRefused"),
+		"tls":               tagged("tls"),
+		"dns":               tagged("dns"),
+		"cancelled":         tagged("cancelled"),
+		"bodyRead":          tagged("bodyRead"),
+		"other":             tagged("other"),
+		"http": func(e Any) Any {
+			return fmt.Sprintf("http %v %v", e.(Dict)["status"], e.(Dict)["body"])
+		},
+	}
+	return Foreign("Fetch")["fetchErrorImpl"].(func(Any, Any) Any)(constructors, err).(string)
+}
+
+func TestFetchErrorKinds(t *testing.T) {
+	slow := slowServer(time.Second)
+	defer slow.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	cases := []struct {
+		url     string
+		options Dict
+		kind    string
+	}{
+		{slow.URL, Dict{"timeout": 20.0}, "timeout"},
+		{secure.URL, Dict{}, "tls"},
+		{closed.URL, Dict{}, "connectionRefused"},
+		{"http://%zz", Dict{}, "other"},
+	}
+	for _, c := range cases {
+		result := fetchResult(t, c.url, c.options)
+		if !result.isLeft {
+			t.Errorf("Expected %s to fail, got %v", c.url, result)
+			continue
+		}
+		if kind := classify(result.value); kind != c.kind {
+			t.Errorf("Expected a %s error for %s, got %s (%v)", c.kind, c.url, kind, result.value)
+		}
+	}
+}
+
+// A network timeout that isn't the timeout option matches both ErrTimeout
+// and the error itself
+func TestNetworkTimeout(t *testing.T) {
+	cause := &url.Error{Op: "Get", URL: "http://example.com", Err: context.DeadlineExceeded}
+	err := fetchError(context.Background(), cause)
+	if err.Name != NameTimeout {
+		t.Errorf("Expected a %s, got %s", NameTimeout, err.Name)
+	}
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the error to match ErrTimeout and its cause, got %v", err)
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || urlErr != cause {
+		t.Errorf("Expected the *url.Error as the cause, got %v", err)
+	}
+}
+
+// Every way a fetch can fail gives an Effect.Exception Error with a name
+func TestFetchErrorsAreErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	badURL := fetchResult(t, "http://%zz", Dict{})
+	badJSON := readResponse(t, "jsonValue", fetchResponse(t, server.URL, Dict{}))
+	noBody := readResponse(t, "text", Dict{})
+	exports := Foreign("Fetch")
+	cases := []struct {
+		err  Any
+		name string
+	}{
+		{badURL.value, NameFetch},
+		{badJSON.value, NameBodyRead},
+		{noBody.value, NameBodyRead},
+		{exports["timeoutError"], NameTimeout},
+		{exports["cancelledError"], NameCancelled},
+	}
+	for _, c := range cases {
+		if _, ok := c.err.(*exceptions.Error); !ok || exceptions.Name(c.err) != c.name {
+			t.Errorf("Expected a %s Error, got %#v", c.name, c.err)
+		}
+	}
+	if !errors.Is(exports["timeoutError"].(error), ErrTimeout) {
+		t.Error("Expected timeoutError to match ErrTimeout")
+	}
+}
+
+func TestEnsureOk(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.Header().Set("X-Reason", "gone")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(bytes.Repeat([]byte("x"), 4096))
+			return
+		}
+		w.Write([]byte("fine"))
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch := exports["fetch"].(func(Any) Any)
+	ensureOk := exports["ensureOk"].(func(Any) Any)
+
+	result := runAff(t, aff.MakeBind(fetch(server.URL), ensureOk))
+	if response, ok := result.value.(Dict); result.isLeft || !ok || response["status"] != 200 {
+		t.Errorf("Expected the 200 response, got %v", result)
+	}
+
+	result = runAff(t, aff.MakeBind(fetch(server.URL+"/missing"), ensureOk))
+	if !result.isLeft {
+		t.Fatalf("Expected a 404 to fail, got %v", result)
+	}
+	if kind := classify(result.value); kind != "http 404 "+strings.Repeat("x", maxErrorBody) {
+		t.Errorf("Expected an HTTP error with a truncated body, got %.40s", kind)
+	}
+	// The error is an Effect.Exception Error, named for its kind
+	if name := exceptions.Name(result.value); name != NameHTTP {
+		t.Errorf("Expected an %s, got %s", NameHTTP, name)
+	}
+	data, _ := exceptions.Data(result.value)
+	if headers := data.(Dict)["headers"].(Dict); headers["x-reason"] != "gone" {
+		t.Errorf("Expected the response headers, got %v", headers)
+	}
+
+	isClientError := exports["isClientError"].(func(Any) Any)
+	if isClientError(Dict{"status": 404}) != true || isClientError(Dict{"status": 500}) != false {
+		t.Error("isClientError should only match 4xx statuses")
+	}
+}
+
+// Callbacks must all run on the goroutine draining the effect queue, so the
+// unsynchronised counters below are safe (checked with go test -race)
+func TestConcurrentFetches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch := exports["fetch"].(func(Any) Any)
+
+	const count = 200
+	succeeded := 0
+	failed := 0
+	for i := 0; i < count; i++ {
+		fiber := Run(Foreign("Effect.Aff")["_makeFiber"].(func(Any, Any) Any)(makeUtil(), fetch(server.URL))).(Dict)
+		Run(fiber["join"].(func(Any) Any)(func(result Any) func() Any {
+			return func() Any {
+				if result.(either).isLeft {
+					failed++
+				} else {
+					succeeded++
+				}
+				return nil
+			}
+		}))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for succeeded+failed < count && time.Now().Before(deadline) {
+		aff.DrainEffectQueue()
+		time.Sleep(time.Millisecond)
+	}
+
+	if succeeded != count {
+		t.Errorf("Expected %d successful fetches, got %d (%d failed)", count, succeeded, failed)
+	}
+}
+
+// fetchWithClient runs fetchWith with a client, returning the Response
+func fetchWithClient(t *testing.T, client Any, url string) Dict {
+	t.Helper()
+	fetchWith := Foreign("Fetch")["fetchWith"].(func(Any, Any, Any) Any)
+	result := runAff(t, fetchWith(client, url, Dict{}))
+	response, ok := result.value.(Dict)
+	if result.isLeft || !ok {
+		t.Fatalf("Expected a Response, got %v", result)
+	}
+	return response
+}
+
+func createClient(options Dict) Any {
+	return Run(Foreign("Fetch")["newClient"].(func(Any) Any)(options))
+}
+
+func TestClientRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	following := fetchWithClient(t, createClient(Dict{}), server.URL+"/old")
+	if following["status"] != 200 || following["redirected"] != true || following["url"] != server.URL+"/new" {
+		t.Errorf("Expected redirect to /new, got %v", following)
+	}
+
+	// A client with a timeout copies each request, which isn't a redirect
+	timed := createClient(Dict{"timeout": 5000.0})
+	if direct := fetchWithClient(t, timed, server.URL+"/new"); direct["redirected"] != false {
+		t.Errorf("Expected no redirect with a timeout client, got %v", direct)
+	}
+	if followed := fetchWithClient(t, timed, server.URL+"/old"); followed["redirected"] != true {
+		t.Errorf("Expected a redirect with a timeout client, got %v", followed)
+	}
+
+	manual := fetchWithClient(t, createClient(Dict{"followRedirects": false}), server.URL+"/old")
+	if manual["status"] != http.StatusFound || manual["redirected"] != false {
+		t.Errorf("Expected unfollowed 302, got %v", manual)
+	}
+
+	fetchWith := Foreign("Fetch")["fetchWith"].(func(Any, Any, Any) Any)
+	if result := runAff(t, fetchWith(createClient(Dict{"maxRedirects": 0}), server.URL+"/old", Dict{})); !result.isLeft {
+		t.Error("Expected an error when exceeding maxRedirects")
+	}
+}
+
+func TestClientCookiesAndHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err == nil {
+			w.Write([]byte(cookie.Value + " " + r.UserAgent()))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+	}))
+	defer server.Close()
+
+	client := createClient(Dict{"cookieJar": true, "headers": Dict{"User-Agent": "go-ffi-test"}})
+	fetchWithClient(t, client, server.URL)
+	response := fetchWithClient(t, client, server.URL)
+
+	text := readResponse(t, "text", response)
+	if text != (either{value: "abc go-ffi-test"}) {
+		t.Errorf("Expected cookie and user agent, got %v", text)
+	}
+}
+
+func TestClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, certificate, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	response := fetchWithClient(t, createClient(Dict{"caBundle": path}), server.URL)
+	if response["status"] != 200 {
+		t.Errorf("Expected status 200, got %v", response["status"])
+	}
+}
+
+func TestRetryingStatus(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch := exports["fetch"].(func(Any) Any)
+	retrying := exports["retrying"].(func(Any, Any) Any)
+
+	result := runAff(t, retrying(Dict{"baseDelay": 1.0}, fetch(server.URL)))
+	response, ok := result.value.(Dict)
+	if result.isLeft || !ok || response["status"] != 200 {
+		t.Fatalf("Expected eventual 200, got %v", result)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+}
+
+func TestRetryingGivesUp(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch_ := exports["fetch'"].(func(Any, Any) Any)
+	retrying := exports["retrying"].(func(Any, Any) Any)
+	policy := Dict{"maxRetries": 2, "baseDelay": 1.0}
+
+	result := runAff(t, retrying(policy, fetch_(server.URL, Dict{})))
+	if response, ok := result.value.(Dict); result.isLeft || !ok || response["status"] != http.StatusBadGateway {
+		t.Fatalf("Expected the last 502, got %v", result)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+
+	// A POST with a buffered body can be sent again
+	atomic.StoreInt32(&attempts, 0)
+	runAff(t, retrying(policy, fetch_(server.URL, Dict{"method": "POST", "body": "data"})))
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("Expected 3 attempts for a POST with a body, got %d", n)
+	}
+
+	// Other POSTs are only replayed when the policy allows it
+	atomic.StoreInt32(&attempts, 0)
+	runAff(t, retrying(policy, fetch_(server.URL, Dict{"method": "POST"})))
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("Expected 1 attempt for a POST without a body, got %d", n)
+	}
+	atomic.StoreInt32(&attempts, 0)
+	allowed := Dict{"maxRetries": 2, "baseDelay": 1.0, "retryNonIdempotent": true}
+	runAff(t, retrying(allowed, fetch_(server.URL, Dict{"method": "POST"})))
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("Expected 3 attempts for an allowed POST, got %d", n)
+	}
+
+	// A body that can't be read again is never replayed
+	streamed := &http.Request{Method: "PUT", Body: io.NopCloser(strings.NewReader("data"))}
+	if replayable(streamed, true) {
+		t.Error("Expected a streamed body not to be replayable")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	// Large delays are capped rather than overflowing
+	policy := retryPolicy{baseDelay: time.Hour, maxDelay: 2 * time.Hour}
+	for _, retry := range []int{0, 1, 2, 31, 62, 100} {
+		delay := policy.backoff(retry)
+		if delay <= 0 || delay > policy.maxDelay {
+			t.Errorf("Expected retry %d to wait at most %v, got %v", retry, policy.maxDelay, delay)
+		}
+	}
+	if delay := policy.backoff(1); delay != 2*time.Hour {
+		t.Errorf("Expected the second retry to wait 2h, got %v", delay)
+	}
+	small := retryPolicy{baseDelay: time.Millisecond, maxDelay: time.Second}
+	if delay := small.backoff(3); delay != 8*time.Millisecond {
+		t.Errorf("Expected 8ms, got %v", delay)
+	}
+}
+
+func TestRetryingConcurrent(t *testing.T) {
+	var gets, posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+		} else {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch_ := exports["fetch'"].(func(Any, Any) Any)
+	retrying := exports["retrying"].(func(Any, Any) Any)
+	policy := Dict{"maxRetries": 2, "baseDelay": 1.0}
+
+	// Each retrying only sees the requests of its own attempts
+	_, getResult := launchAff(retrying(policy, fetch_(server.URL, Dict{})))
+	_, postResult := launchAff(retrying(policy, fetch_(server.URL, Dict{"method": "POST"})))
+	awaitResult(t, getResult)
+	awaitResult(t, postResult)
+	if g, p := atomic.LoadInt32(&gets), atomic.LoadInt32(&posts); g != 3 || p != 1 {
+		t.Errorf("Expected 3 GETs and 1 POST, got %d and %d", g, p)
+	}
+}
+
+func TestRetryingNetworkErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// Drop the connection without a response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	exports := Foreign("Fetch")
+	fetch := exports["fetch"].(func(Any) Any)
+	retrying := exports["retrying"].(func(Any, Any) Any)
+
+	result := runAff(t, retrying(Dict{"baseDelay": 1.0}, fetch(server.URL)))
+	if result.isLeft {
+		t.Fatalf("Expected success after a network error, got %v", result)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	result = runAff(t, retrying(Dict{"retryNetworkErrors": false}, fetch(server.URL)))
+	if !result.isLeft || atomic.LoadInt32(&attempts) != 1 {
+		t.Errorf("Expected the network error without retrying, got %v", result)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
 	. "github.com/purescript-native/go-runtime"
 )
 
@@ -208,6 +210,16 @@ func init() {
 		}
 	}
 
+	// fiberDebug :: Request -> ResponseM
+	// Serves Effect.Aff's FiberDebugHandler, which describes the running
+	// fibers while fiber debug mode is on
+	exports["fiberDebug"] = func(req_ Any) Any {
+		return func() Any {
+			req := req_.(Dict)["_request"].(*http.Request)
+			return serveHandler(aff.FiberDebugHandler(), req)
+		}
+	}
+
 	// Request accessors
 
 	// method :: Request -> Method
@@ -351,6 +363,22 @@ func wrapRequest(r *http.Request) Dict {
 	}
 }
 
+// serveHandler runs a Go handler for a request, returning what it wrote
+// as a Response
+func serveHandler(handler http.Handler, req *http.Request) Dict {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	headers := Dict{}
+	for key := range recorder.Header() {
+		headers[key] = recorder.Header().Get(key)
+	}
+	return Dict{
+		"status":  recorder.Code,
+		"headers": headers,
+		"body":    recorder.Body.String(),
+	}
+}
+
 func applyResponse(w http.ResponseWriter, response Dict) {
 	// Set status code
 	status := 200
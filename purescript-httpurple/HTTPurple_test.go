@@ -6,6 +6,7 @@ import (
 	"strings"
 	"testing"
 
+	aff "github.com/i-am-the-slime/go-ffi/purescript-aff"
 	. "github.com/purescript-native/go-runtime"
 )
 
@@ -277,3 +278,23 @@ func TestStatusCodes(t *testing.T) {
 	}
 }
 
+
+func TestFiberDebug(t *testing.T) {
+	fiberDebug := Foreign("HTTPurple")["fiberDebug"].(func(Any) Any)
+	aff.EnableFiberDebug(true)
+	defer aff.EnableFiberDebug(false)
+	// The fiber is never run, so its Either constructors are never used
+	id := func(v Any) Any { return v }
+	util := Dict{"isLeft": id, "left": id, "right": id, "fromLeft": id, "fromRight": id}
+	aff.Fiber(util, nil, aff.MakePure(nil))
+
+	resp := Run(fiberDebug(wrapRequest(httptest.NewRequest("GET", "/debug/fibers", nil)))).(Dict)
+	if body := resp["body"].(string); !strings.HasPrefix(body, "1 fibers\n") {
+		t.Errorf("Expected one fiber, got %q", body)
+	}
+
+	resp = Run(fiberDebug(wrapRequest(httptest.NewRequest("GET", "/debug/fibers?format=json", nil)))).(Dict)
+	if resp["headers"].(Dict)["Content-Type"] != "application/json" || !strings.Contains(resp["body"].(string), `"status":"SUSPENDED"`) {
+		t.Errorf("Expected a JSON snapshot, got %v", resp)
+	}
+}
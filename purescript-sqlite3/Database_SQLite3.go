@@ -1,15 +1,18 @@
 package purescript_sqlite3
 
 import (
+	"container/list"
 	"database/sql"
-	"fmt"
+	"sync"
+	"sync/atomic"
 
 	_ "github.com/mattn/go-sqlite3"
+	exceptions "github.com/i-am-the-slime/go-ffi/purescript-exceptions"
 	. "github.com/purescript-native/go-runtime"
 )
 
 func init() {
-	exports := Foreign("Database.SQLite3")
+	exports := exceptions.RegisterExports("Database.SQLite3")
 
 	// open :: String -> Effect Database
 	exports["open"] = func(path_ Any) Any {
@@ -17,10 +20,7 @@ func init() {
 			path := path_.(string)
 			db, err := sql.Open("sqlite3", path)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Failed to open database: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Failed to open database: %w", err))
 			}
 			return db
 		}
@@ -30,12 +30,10 @@ func init() {
 	exports["close"] = func(db_ Any) Any {
 		return func() Any {
 			db := db_.(*sql.DB)
+			dropStatementCache(db)
 			err := db.Close()
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Failed to close database: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Failed to close database: %w", err))
 			}
 			return nil
 		}
@@ -48,33 +46,30 @@ func init() {
 			db := db_.(*sql.DB)
 			_, err := db.Exec(query)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
 			}
 			return nil
 		}
 	}
 
-	// exec' :: String -> Array Any -> Database -> Effect Unit
+	// exec' :: String -> Array Any -> Database -> Effect { changes :: Int, lastInsertRowid :: Nullable Int }
 	exports["exec'"] = func(query_ Any, args_ Any, db_ Any) Any {
 		return func() Any {
 			query := query_.(string)
 			args := args_.([]Any)
 			db := db_.(*sql.DB)
-			_, err := db.Exec(query, args...)
+			result, err := db.Exec(query, args...)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
 			}
-			return nil
+			return runInfo(result)
 		}
 	}
 
 	// query :: String -> Database -> Effect (Array (Object Any))
+	// Object rows have the driver's values, except that BLOBs are strings
+	// like TEXT: integers are int64s. The raw exports convert values for
+	// Foreign's readers instead (see queryRaw).
 	exports["query"] = func(query_ Any, db_ Any) Any {
 		return func() Any {
 			query := query_.(string)
@@ -82,10 +77,7 @@ func init() {
 			
 			rows, err := db.Query(query)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
 			}
 			defer rows.Close()
 			
@@ -102,10 +94,7 @@ func init() {
 			
 			rows, err := db.Query(query, args...)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
 			}
 			defer rows.Close()
 			
@@ -121,10 +110,7 @@ func init() {
 			
 			rows, err := db.Query(query)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
 			}
 			defer rows.Close()
 			
@@ -145,10 +131,7 @@ func init() {
 			
 			rows, err := db.Query(query, args...)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
 			}
 			defer rows.Close()
 			
@@ -160,17 +143,68 @@ func init() {
 		}
 	}
 
+	// queryRaw :: String -> Database -> Effect { columns :: Array String, rows :: Array (Array Any) }
+	// Unlike object rows, raw rows have integers as numbers and BLOBs as
+	// bytes, as the typed layer reads them (see eachRawRow)
+	exports["queryRaw"] = func(query_ Any, db_ Any) Any {
+		return func() Any {
+			query := query_.(string)
+			db := db_.(*sql.DB)
+
+			rows, err := db.Query(query)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			return scanRaw(rows)
+		}
+	}
+
+	// queryRaw' :: String -> Array Any -> Database -> Effect { columns :: Array String, rows :: Array (Array Any) }
+	exports["queryRaw'"] = func(query_ Any, args_ Any, db_ Any) Any {
+		return func() Any {
+			query := query_.(string)
+			args := args_.([]Any)
+			db := db_.(*sql.DB)
+
+			rows, err := db.Query(query, args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			return scanRaw(rows)
+		}
+	}
+
+	// queryOneRaw' :: String -> Array Any -> Database -> Effect (Maybe (Array Any))
+	exports["queryOneRaw'"] = func(query_ Any, args_ Any, db_ Any) Any {
+		return func() Any {
+			query := query_.(string)
+			args := args_.([]Any)
+			db := db_.(*sql.DB)
+
+			rows, err := db.Query(query, args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			return firstRaw(rows)
+		}
+	}
+
 	// lastInsertRowId :: Database -> Effect Int
+	// This may ask a different pooled connection than the insert used; the
+	// lastInsertRowid exec' returns comes from the insert itself
 	exports["lastInsertRowId"] = func(db_ Any) Any {
 		return func() Any {
 			db := db_.(*sql.DB)
 			var id int64
 			err := db.QueryRow("SELECT last_insert_rowid()").Scan(&id)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Failed to get last insert ID: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Failed to get last insert ID: %w", err))
 			}
 			return int(id)
 		}
@@ -182,10 +216,7 @@ func init() {
 			db := db_.(*sql.DB)
 			tx, err := db.Begin()
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Failed to begin transaction: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Failed to begin transaction: %w", err))
 			}
 			return tx
 		}
@@ -197,10 +228,7 @@ func init() {
 			tx := tx_.(*sql.Tx)
 			err := tx.Commit()
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Failed to commit transaction: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Failed to commit transaction: %w", err))
 			}
 			return nil
 		}
@@ -212,45 +240,299 @@ func init() {
 			tx := tx_.(*sql.Tx)
 			err := tx.Rollback()
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Failed to rollback transaction: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Failed to rollback transaction: %w", err))
 			}
 			return nil
 		}
 	}
 
-	// execTx :: String -> Array Any -> Transaction -> Effect Unit
+	// execTx :: String -> Array Any -> Transaction -> Effect { changes :: Int, lastInsertRowid :: Nullable Int }
 	exports["execTx"] = func(query_ Any, args_ Any, tx_ Any) Any {
 		return func() Any {
 			query := query_.(string)
 			args := args_.([]Any)
 			tx := tx_.(*sql.Tx)
-			_, err := tx.Exec(query, args...)
+			result, err := tx.Exec(query, args...)
+			if err != nil {
+				panic(exceptions.Errorf("Transaction query failed: %w", err))
+			}
+			return runInfo(result)
+		}
+	}
+
+	// prepare :: String -> Database -> Effect Statement
+	// Statements come from the database's cache when they can, so preparing
+	// a query that was prepared recently costs a map lookup
+	exports["prepare"] = func(query_ Any, db_ Any) Any {
+		return func() Any {
+			query := query_.(string)
+			db := db_.(*sql.DB)
+			stmt, err := Prepare(db, query)
+			if err != nil {
+				panic(exceptions.Errorf("Failed to prepare statement: %w", err))
+			}
+			return stmt
+		}
+	}
+
+	// runImpl :: Array Any -> Statement -> Effect { changes :: Int, lastInsertRowid :: Nullable Int }
+	exports["runImpl"] = func(args_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			stmt := stmt_.(*Statement)
+			result, err := stmt.use().Exec(args...)
 			if err != nil {
-				panic(Dict{
-					"message": fmt.Sprintf("Transaction query failed: %v", err),
-					"stack":   "",
-				})
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			return runInfo(result)
+		}
+	}
+
+	// allImpl :: Array Any -> Statement -> Effect (Array (Object Any))
+	// The rows' values are as query's
+	exports["allImpl"] = func(args_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			stmt := stmt_.(*Statement)
+			rows, err := stmt.use().Query(args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			return scanRows(rows)
+		}
+	}
+
+	// getImpl :: Array Any -> Statement -> Effect (Maybe (Object Any))
+	// The row's values are as query's
+	exports["getImpl"] = func(args_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			stmt := stmt_.(*Statement)
+			rows, err := stmt.use().Query(args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			var result Any = Dict{} // Nothing
+			eachRow(rows, func(row Dict) bool {
+				result = Dict{"value0": row} // Just
+				return false
+			})
+			return result
+		}
+	}
+
+	// iterateImpl :: Array Any -> (Object Any -> Effect Unit) -> Statement -> Effect Unit
+	// Rows are read one at a time, so large results needn't fit in memory.
+	// Their values are as query's.
+	exports["iterateImpl"] = func(args_ Any, f_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			f := f_.(func(Any) Any)
+			stmt := stmt_.(*Statement)
+			rows, err := stmt.use().Query(args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			eachRow(rows, func(row Dict) bool {
+				f(row).(func() Any)()
+				return true
+			})
+			return nil
+		}
+	}
+
+	// allRawImpl :: Array Any -> Statement -> Effect { columns :: Array String, rows :: Array (Array Any) }
+	// The rows' values are as queryRaw's
+	exports["allRawImpl"] = func(args_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			stmt := stmt_.(*Statement)
+			rows, err := stmt.use().Query(args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			return scanRaw(rows)
+		}
+	}
+
+	// getRawImpl :: Array Any -> Statement -> Effect (Maybe (Array Any))
+	// The row's values are as queryRaw's
+	exports["getRawImpl"] = func(args_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			stmt := stmt_.(*Statement)
+			rows, err := stmt.use().Query(args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			return firstRaw(rows)
+		}
+	}
+
+	// iterateRawImpl :: Array Any -> (Array Any -> Effect Unit) -> Statement -> Effect Unit
+	// The rows' values are as queryRaw's
+	exports["iterateRawImpl"] = func(args_ Any, f_ Any, stmt_ Any) Any {
+		return func() Any {
+			args := args_.([]Any)
+			f := f_.(func(Any) Any)
+			stmt := stmt_.(*Statement)
+			rows, err := stmt.use().Query(args...)
+			if err != nil {
+				panic(exceptions.Errorf("Query failed: %w", err))
+			}
+			defer rows.Close()
+
+			eachRawRow(rows, func(row []Any) bool {
+				f(row).(func() Any)()
+				return true
+			})
+			return nil
+		}
+	}
+
+	// finalize :: Statement -> Effect Unit
+	exports["finalize"] = func(stmt_ Any) Any {
+		return func() Any {
+			stmt := stmt_.(*Statement)
+			stmt.Finalize()
+			return nil
+		}
+	}
+
+	// statementSource :: Statement -> String
+	exports["statementSource"] = func(stmt_ Any) Any {
+		stmt := stmt_.(*Statement)
+		return stmt.SQL
+	}
+
+	// setStatementCacheSize :: Int -> Database -> Effect Unit
+	exports["setStatementCacheSize"] = func(size_ Any, db_ Any) Any {
+		return func() Any {
+			size := size_.(int)
+			db := db_.(*sql.DB)
+			if size < 0 {
+				panic(exceptions.Errorf("Statement cache size must be at least 0, got %d", size))
 			}
+			SetStatementCacheSize(db, size)
 			return nil
 		}
 	}
 }
 
+// runInfo converts an exec's result to { changes, lastInsertRowid },
+// with null for drivers that don't report the row ID
+func runInfo(result sql.Result) Dict {
+	info := Dict{"changes": 0, "lastInsertRowid": nil}
+	if changes, err := result.RowsAffected(); err == nil {
+		info["changes"] = int(changes)
+	}
+	if id, err := result.LastInsertId(); err == nil {
+		info["lastInsertRowid"] = int(id)
+	}
+	return info
+}
+
 // scanRows converts sql.Rows to []Any (array of objects)
 func scanRows(rows *sql.Rows) []Any {
+	results := []Any{}
+	eachRow(rows, func(row Dict) bool {
+		results = append(results, row)
+		return true
+	})
+	return results
+}
+
+// scanRaw converts sql.Rows to { columns, rows }, with each row an array
+// in column order
+func scanRaw(rows *sql.Rows) Dict {
+	results := []Any{}
+	columns := eachRawRow(rows, func(row []Any) bool {
+		results = append(results, row)
+		return true
+	})
+	names := make([]Any, len(columns))
+	for i, col := range columns {
+		names[i] = col
+	}
+	return Dict{"columns": names, "rows": results}
+}
+
+// firstRaw returns the first row as an array, as a Maybe
+func firstRaw(rows *sql.Rows) Dict {
+	result := Dict{} // Nothing
+	eachRawRow(rows, func(row []Any) bool {
+		result = Dict{"value0": row} // Just
+		return false
+	})
+	return result
+}
+
+// eachRow calls f with each row as an object until it returns false. BLOBs
+// become strings and integers stay int64, as object rows have always had
+// them; eachRawRow converts values for the typed layer instead.
+func eachRow(rows *sql.Rows, f func(Dict) bool) {
+	eachValues(rows, func(columns []string, values []interface{}) bool {
+		// Create a map for this row
+		row := make(Dict)
+		for i, col := range columns {
+			val := values[i]
+			
+			// Convert []byte to string (SQLite TEXT)
+			if b, ok := val.([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = val
+			}
+		}
+		return f(row)
+	})
+}
+
+// maxSafeInteger is the largest integer a float64 holds exactly (2^53 - 1)
+const maxSafeInteger = 1<<53 - 1
+
+// eachRawRow calls f with each row as an array until it returns false,
+// returning the column names. Integers are numbers, as they'd arrive in
+// JavaScript, so Foreign's readers accept them. Integers a number can't
+// hold exactly stay int64, which the readers reject rather than round.
+// TEXT is a string and BLOB stays []byte.
+func eachRawRow(rows *sql.Rows, f func([]Any) bool) []string {
+	return eachValues(rows, func(columns []string, values []interface{}) bool {
+		row := make([]Any, len(values))
+		for i, val := range values {
+			switch v := val.(type) {
+			case int64:
+				if v >= -maxSafeInteger && v <= maxSafeInteger {
+					row[i] = float64(v)
+				} else {
+					row[i] = v
+				}
+			default:
+				row[i] = v
+			}
+		}
+		return f(row)
+	})
+}
+
+// eachValues scans each row and calls f with its values until it returns
+// false, returning the column names
+func eachValues(rows *sql.Rows, f func(columns []string, values []interface{}) bool) []string {
 	columns, err := rows.Columns()
 	if err != nil {
-		panic(Dict{
-			"message": fmt.Sprintf("Failed to get columns: %v", err),
-			"stack":   "",
-		})
+		panic(exceptions.Errorf("Failed to get columns: %w", err))
 	}
 
-	results := []Any{}
-	
 	for rows.Next() {
 		// Create a slice of interface{} to hold each column value
 		values := make([]interface{}, len(columns))
@@ -261,35 +543,196 @@ func scanRows(rows *sql.Rows) []Any {
 
 		// Scan the row into the value pointers
 		if err := rows.Scan(valuePtrs...); err != nil {
-			panic(Dict{
-				"message": fmt.Sprintf("Failed to scan row: %v", err),
-				"stack":   "",
-			})
+			panic(exceptions.Errorf("Failed to scan row: %w", err))
 		}
 
-		// Create a map for this row
-		row := make(Dict)
-		for i, col := range columns {
-			val := values[i]
-			
-			// Convert []byte to string (SQLite TEXT)
-			if b, ok := val.([]byte); ok {
-				row[col] = string(b)
-			} else {
-				row[col] = val
-			}
+		if !f(columns, values) {
+			return columns
 		}
-		
-		results = append(results, row)
 	}
 
 	if err := rows.Err(); err != nil {
-		panic(Dict{
-			"message": fmt.Sprintf("Row iteration error: %v", err),
-			"stack":   "",
-		})
+		panic(exceptions.Errorf("Row iteration error: %w", err))
 	}
+	return columns
+}
 
-	return results
+// DefaultStatementCacheSize is how many statements each database keeps
+// prepared after they're finalized
+const DefaultStatementCacheSize = 64
+
+// Statement is a prepared statement. Statements for the same SQL on the
+// same database share a *sql.Stmt, which stays prepared while it's in the
+// database's cache or used by a Statement that hasn't been finalized.
+//
+// The cache belongs to the *sql.DB, which is a pool of connections, not to
+// any one connection: database/sql prepares a cached statement again on
+// each connection it runs on.
+type Statement struct {
+	SQL string
+
+	cache     *stmtCache
+	entry     *cachedStmt
+	finalized int32
+}
+
+// Prepare creates a Statement, reusing the database's cached *sql.Stmt
+// for query if it has one
+func Prepare(db *sql.DB, query string) (*Statement, error) {
+	cache := statementCache(db)
+	entry, err := cache.acquire(db, query)
+	if err != nil {
+		return nil, err
+	}
+	return &Statement{SQL: query, cache: cache, entry: entry}, nil
+}
+
+// Finalize releases the statement. Using it afterwards panics; finalizing
+// it again does nothing.
+func (s *Statement) Finalize() {
+	if atomic.CompareAndSwapInt32(&s.finalized, 0, 1) {
+		s.cache.release(s.entry)
+	}
+}
+
+func (s *Statement) use() *sql.Stmt {
+	if atomic.LoadInt32(&s.finalized) == 1 {
+		panic(exceptions.Errorf("Statement has been finalized: %s", s.SQL))
+	}
+	return s.entry.stmt
+}
+
+// SetStatementCacheSize changes how many statements db keeps prepared. A
+// size of 0 turns caching off.
+func SetStatementCacheSize(db *sql.DB, size int) {
+	cache := statementCache(db)
+	cache.mu.Lock()
+	cache.size = size
+	unused := cache.evict()
+	cache.mu.Unlock()
+	closeStmts(unused)
 }
 
+// cachedStmt is a *sql.Stmt and the Statements using it
+type cachedStmt struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int           // Statements not yet finalized
+	element *list.Element // nil once evicted
+}
+
+// stmtCache keeps a database's most recently used statements prepared.
+// Statements are only closed once nothing uses them: evicted or dropped
+// entries that are still in use are closed by the last Finalize.
+type stmtCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // most recently used first
+	entries map[string]*cachedStmt
+}
+
+var statementCaches = struct {
+	sync.Mutex
+	dbs map[*sql.DB]*stmtCache
+}{dbs: map[*sql.DB]*stmtCache{}}
+
+func statementCache(db *sql.DB) *stmtCache {
+	statementCaches.Lock()
+	defer statementCaches.Unlock()
+	cache, ok := statementCaches.dbs[db]
+	if !ok {
+		cache = &stmtCache{size: DefaultStatementCacheSize, lru: list.New(), entries: map[string]*cachedStmt{}}
+		statementCaches.dbs[db] = cache
+	}
+	return cache
+}
+
+// dropStatementCache closes db's cached statements before db is closed.
+// Statements that haven't been finalized keep theirs, which fail once db is
+// closed.
+func dropStatementCache(db *sql.DB) {
+	statementCaches.Lock()
+	cache, ok := statementCaches.dbs[db]
+	delete(statementCaches.dbs, db)
+	statementCaches.Unlock()
+	if !ok {
+		return
+	}
+
+	cache.mu.Lock()
+	size := cache.size
+	cache.size = 0
+	unused := cache.evict()
+	cache.size = size
+	cache.mu.Unlock()
+	closeStmts(unused)
+}
+
+func (c *stmtCache) acquire(db *sql.DB, query string) (*cachedStmt, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[query]; ok {
+		c.lru.MoveToFront(entry.element)
+		entry.refs++
+		c.mu.Unlock()
+		return entry, nil
+	}
+	c.mu.Unlock()
+
+	// Preparing waits for a connection, which a transaction that wants this
+	// lock may be holding
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if entry, ok := c.entries[query]; ok {
+		// Prepared by someone else in the meantime
+		c.lru.MoveToFront(entry.element)
+		entry.refs++
+		c.mu.Unlock()
+		stmt.Close()
+		return entry, nil
+	}
+	entry := &cachedStmt{query: query, stmt: stmt, refs: 1}
+	var unused []*cachedStmt
+	if c.size > 0 {
+		entry.element = c.lru.PushFront(entry)
+		c.entries[query] = entry
+		unused = c.evict()
+	}
+	c.mu.Unlock()
+	closeStmts(unused)
+	return entry, nil
+}
+
+func (c *stmtCache) release(entry *cachedStmt) {
+	c.mu.Lock()
+	entry.refs--
+	unused := entry.refs == 0 && entry.element == nil
+	c.mu.Unlock()
+	if unused {
+		entry.stmt.Close()
+	}
+}
+
+// evict removes the least recently used statements over the cache's size,
+// returning those no Statement is using, to be closed once c is unlocked
+func (c *stmtCache) evict() []*cachedStmt {
+	var unused []*cachedStmt
+	for c.lru.Len() > c.size {
+		entry := c.lru.Remove(c.lru.Back()).(*cachedStmt)
+		entry.element = nil
+		delete(c.entries, entry.query)
+		if entry.refs == 0 {
+			unused = append(unused, entry)
+		}
+	}
+	return unused
+}
+
+func closeStmts(entries []*cachedStmt) {
+	for _, entry := range entries {
+		entry.stmt.Close()
+	}
+}
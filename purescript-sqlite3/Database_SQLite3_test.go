@@ -1,9 +1,14 @@
 package purescript_sqlite3
 
 import (
+	"database/sql"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	_ "github.com/i-am-the-slime/go-ffi/purescript-foreign"
+	_ "github.com/i-am-the-slime/go-ffi/purescript-integers"
 	. "github.com/purescript-native/go-runtime"
 )
 
@@ -298,3 +303,351 @@ func TestFileDatabase(t *testing.T) {
 	}
 }
 
+
+func TestPreparedStatement(t *testing.T) {
+	exports := Foreign("Database.SQLite3")
+	open := exports["open"].(func(Any) Any)
+	exec := exports["exec"].(func(Any, Any) Any)
+	prepare := exports["prepare"].(func(Any, Any) Any)
+	run := exports["runImpl"].(func(Any, Any) Any)
+	all := exports["allImpl"].(func(Any, Any) Any)
+	get := exports["getImpl"].(func(Any, Any) Any)
+	iterate := exports["iterateImpl"].(func(Any, Any, Any) Any)
+	finalize := exports["finalize"].(func(Any) Any)
+	close := exports["close"].(func(Any) Any)
+
+	db := open(":memory:").(func() Any)()
+	defer close(db).(func() Any)()
+
+	exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, age INTEGER)", db).(func() Any)()
+
+	insert := prepare("INSERT INTO users (name, age) VALUES (?, ?)", db).(func() Any)()
+	info := run([]Any{"Alice", 25}, insert).(func() Any)().(Dict)
+	if info["changes"] != 1 || info["lastInsertRowid"] != 1 {
+		t.Errorf("Expected 1 change and row ID 1, got %v", info)
+	}
+	run([]Any{"Bob", 30}, insert).(func() Any)()
+	run([]Any{"Carol", 35}, insert).(func() Any)()
+
+	older := prepare("SELECT name FROM users WHERE age > ? ORDER BY id", db).(func() Any)()
+	if results := all([]Any{26}, older).(func() Any)().([]Any); len(results) != 2 || results[0].(Dict)["name"] != "Bob" {
+		t.Errorf("Expected Bob and Carol, got %v", results)
+	}
+
+	result := get([]Any{32}, older).(func() Any)().(Dict)
+	if row, ok := result["value0"].(Dict); !ok || row["name"] != "Carol" {
+		t.Errorf("Expected Just Carol, got %v", result)
+	}
+	if result := get([]Any{99}, older).(func() Any)().(Dict); len(result) != 0 {
+		t.Errorf("Expected Nothing, got %v", result)
+	}
+
+	var names []Any
+	iterate([]Any{0}, func(row Any) Any {
+		return func() Any {
+			names = append(names, row.(Dict)["name"])
+			return nil
+		}
+	}, older).(func() Any)()
+	if len(names) != 3 || names[2] != "Carol" {
+		t.Errorf("Expected every name in order, got %v", names)
+	}
+
+	update := prepare("UPDATE users SET age = age + 1", db).(func() Any)()
+	if info := run([]Any{}, update).(func() Any)().(Dict); info["changes"] != 3 {
+		t.Errorf("Expected 3 changes, got %v", info)
+	}
+
+	finalize(older).(func() Any)()
+	finalize(older).(func() Any)()
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected using a finalized statement to panic")
+		}
+	}()
+	all([]Any{0}, older).(func() Any)()
+}
+
+func TestStatementCache(t *testing.T) {
+	exports := Foreign("Database.SQLite3")
+	db := exports["open"].(func(Any) Any)(":memory:").(func() Any)().(*sql.DB)
+	defer exports["close"].(func(Any) Any)(db).(func() Any)()
+
+	first, _ := Prepare(db, "SELECT 1")
+	second, _ := Prepare(db, "SELECT 1")
+	if first.entry.stmt != second.entry.stmt {
+		t.Error("Expected statements for the same SQL to share a prepared statement")
+	}
+
+	// Finalized statements stay prepared until they're evicted
+	first.Finalize()
+	second.Finalize()
+	third, _ := Prepare(db, "SELECT 1")
+	if third.entry != first.entry {
+		t.Error("Expected the finalized statement to be reused from the cache")
+	}
+	third.Finalize()
+
+	SetStatementCacheSize(db, 1)
+	other, _ := Prepare(db, "SELECT 2")
+	if _, err := first.entry.stmt.Exec(); err == nil {
+		t.Error("Expected the evicted statement to be closed")
+	}
+
+	// Evicted statements in use stay prepared until they're finalized
+	SetStatementCacheSize(db, 0)
+	if _, err := other.use().Exec(); err != nil {
+		t.Errorf("Expected the statement to stay usable, got %v", err)
+	}
+	uncached, _ := Prepare(db, "SELECT 2")
+	if uncached.entry == other.entry {
+		t.Error("Expected a new statement with caching off")
+	}
+	other.Finalize()
+	uncached.Finalize()
+	if _, err := uncached.entry.stmt.Exec(); err == nil {
+		t.Error("Expected the uncached statement to be closed when finalized")
+	}
+
+	// Dropping the cache only closes statements nothing is using
+	SetStatementCacheSize(db, DefaultStatementCacheSize)
+	held, _ := Prepare(db, "SELECT 3")
+	idle, _ := Prepare(db, "SELECT 4")
+	idle.Finalize()
+	dropStatementCache(db)
+	if _, err := idle.entry.stmt.Exec(); err == nil {
+		t.Error("Expected the unused statement to be closed")
+	}
+	if _, err := held.use().Exec(); err != nil {
+		t.Errorf("Expected the held statement to stay usable, got %v", err)
+	}
+	held.Finalize()
+	if _, err := held.entry.stmt.Exec(); err == nil {
+		t.Error("Expected the held statement to be closed when finalized")
+	}
+}
+
+func TestExecInfo(t *testing.T) {
+	exports := Foreign("Database.SQLite3")
+	open := exports["open"].(func(Any) Any)
+	exec_ := exports["exec'"].(func(Any, Any, Any) Any)
+	beginTransaction := exports["beginTransaction"].(func(Any) Any)
+	execTx := exports["execTx"].(func(Any, Any, Any) Any)
+	commit := exports["commit"].(func(Any) Any)
+	close := exports["close"].(func(Any) Any)
+
+	db := open(":memory:").(func() Any)()
+	defer close(db).(func() Any)()
+
+	exec_("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)", []Any{}, db).(func() Any)()
+	info := exec_("INSERT INTO users (name) VALUES (?), (?)", []Any{"Alice", "Bob"}, db).(func() Any)().(Dict)
+	if info["changes"] != 2 || info["lastInsertRowid"] != 2 {
+		t.Errorf("Expected 2 changes and row ID 2, got %v", info)
+	}
+
+	tx := beginTransaction(db).(func() Any)()
+	info = execTx("INSERT INTO users (name) VALUES (?)", []Any{"Carol"}, tx).(func() Any)().(Dict)
+	if info["changes"] != 1 || info["lastInsertRowid"] != 3 {
+		t.Errorf("Expected 1 change and row ID 3, got %v", info)
+	}
+	info = execTx("UPDATE users SET name = upper(name) WHERE id < ?", []Any{3}, tx).(func() Any)().(Dict)
+	if info["changes"] != 2 {
+		t.Errorf("Expected 2 changes, got %v", info)
+	}
+	commit(tx).(func() Any)()
+
+	info = exec_("DELETE FROM users", []Any{}, db).(func() Any)().(Dict)
+	if info["changes"] != 3 {
+		t.Errorf("Expected 3 changes, got %v", info)
+	}
+}
+
+func TestQueryRaw(t *testing.T) {
+	exports := Foreign("Database.SQLite3")
+	open := exports["open"].(func(Any) Any)
+	exec_ := exports["exec'"].(func(Any, Any, Any) Any)
+	queryRaw := exports["queryRaw"].(func(Any, Any) Any)
+	queryRaw_ := exports["queryRaw'"].(func(Any, Any, Any) Any)
+	queryOneRaw_ := exports["queryOneRaw'"].(func(Any, Any, Any) Any)
+	close := exports["close"].(func(Any) Any)
+
+	db := open(":memory:").(func() Any)()
+	defer close(db).(func() Any)()
+
+	exec_("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL, avatar BLOB)", []Any{}, db).(func() Any)()
+	exec_("INSERT INTO users (name, score, avatar) VALUES (?, ?, ?)", []Any{"Alice", 1.5, []byte("png")}, db).(func() Any)()
+	exec_("INSERT INTO users (name) VALUES (?)", []Any{"Bob"}, db).(func() Any)()
+
+	// Columns come back in the order the query names them
+	result := queryRaw("SELECT name, id, score, avatar FROM users ORDER BY id", db).(func() Any)().(Dict)
+	columns := result["columns"].([]Any)
+	if len(columns) != 4 || columns[0] != "name" || columns[3] != "avatar" {
+		t.Errorf("Expected name, id, score, avatar, got %v", columns)
+	}
+	rows := result["rows"].([]Any)
+	alice, bob := rows[0].([]Any), rows[1].([]Any)
+	if alice[0] != "Alice" || alice[1] != 1.0 || alice[2] != 1.5 {
+		t.Errorf("Expected Alice's values as strings and numbers, got %v", alice)
+	}
+	if avatar, ok := alice[3].([]byte); !ok || string(avatar) != "png" {
+		t.Errorf("Expected the BLOB as bytes, got %#v", alice[3])
+	}
+	if bob[2] != nil || bob[3] != nil {
+		t.Errorf("Expected nulls for Bob, got %v", bob)
+	}
+
+	// Object rows keep the driver's integers and read BLOBs as strings
+	query := exports["query"].(func(Any, Any) Any)
+	objects := query("SELECT id, avatar FROM users ORDER BY id", db).(func() Any)().([]Any)
+	if row := objects[0].(Dict); row["id"] != int64(1) || row["avatar"] != "png" {
+		t.Errorf("Expected an int64 ID and a string BLOB in object rows, got %#v", row)
+	}
+
+	result = queryRaw_("SELECT id FROM users WHERE name = ?", []Any{"Bob"}, db).(func() Any)().(Dict)
+	if rows := result["rows"].([]Any); len(rows) != 1 || rows[0].([]Any)[0] != 2.0 {
+		t.Errorf("Expected Bob's id, got %v", result)
+	}
+
+	// Integers a number can't hold exactly aren't rounded
+	big := queryRaw("SELECT 9007199254740993, -9007199254740991", db).(func() Any)().(Dict)
+	if row := big["rows"].([]Any)[0].([]Any); row[0] != int64(9007199254740993) || row[1] != -9007199254740991.0 {
+		t.Errorf("Expected the large integer as int64 and the safe one as a number, got %#v", row)
+	}
+
+	one := queryOneRaw_("SELECT name FROM users WHERE id > ?", []Any{0}, db).(func() Any)().(Dict)
+	if row, ok := one["value0"].([]Any); !ok || row[0] != "Alice" {
+		t.Errorf("Expected Just [Alice], got %v", one)
+	}
+	if none := queryOneRaw_("SELECT name FROM users WHERE id > ?", []Any{9}, db).(func() Any)().(Dict); len(none) != 0 {
+		t.Errorf("Expected Nothing, got %v", none)
+	}
+}
+
+// readResult stands in for SQLTypes' SQLFromForeign instances, which can't
+// be compiled here. It reaches the same FFI they do, Foreign's tags and
+// Data.Int's fromNumber, but nothing checks it against them.
+func readResult(t *testing.T, typ string, value Any) Any {
+	t.Helper()
+	tag := Foreign("Foreign")["tagOf"].(func(Any) Any)(value)
+	switch typ {
+	case "Int":
+		if tag == "Number" {
+			just := func(v Any) Any { return Dict{"value0": v} }
+			fromNumber := Foreign("Data.Int")["fromNumberImpl"].(func(Any) Any)(Fn(just)).(func(Any) Any)(Dict{}).(func(Any) Any)
+			if result, ok := fromNumber(value).(Dict)["value0"]; ok {
+				return result
+			}
+		}
+	case "String", "Boolean", "Number":
+		if tag == typ {
+			return value
+		}
+	}
+	t.Fatalf("Can't read %v (tagged %v) as %s", value, tag, typ)
+	return nil
+}
+
+// readmeQueries reads the SQL the typed README's examples prepare from
+// testdata/typed_readme.sql, where each statement follows a comment naming
+// its example
+func readmeQueries(t *testing.T) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "typed_readme.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := map[string]string{}
+	name := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "-- "):
+			name = strings.SplitN(strings.TrimPrefix(line, "-- "), ":", 2)[0]
+		case strings.TrimSpace(line) == "":
+			name = ""
+		case name != "":
+			queries[name] = strings.TrimSpace(queries[name] + " " + line)
+		}
+	}
+	return queries
+}
+
+// TestTypedReadmeExamples checks the exports the purescript-sqlite3-typed
+// layer calls with its README's examples. It isn't an end-to-end test of
+// the typed layer, none of which is compiled here: the SQL comes from a
+// hand-maintained golden file, the parameters are passed in the order
+// argsFor would pass them, and readResult decodes the rows.
+func TestTypedReadmeExamples(t *testing.T) {
+	queries := readmeQueries(t)
+	exports := Foreign("Database.SQLite3")
+	open := exports["open"].(func(Any) Any)
+	prepare := exports["prepare"].(func(Any, Any) Any)
+	run := exports["runImpl"].(func(Any, Any) Any)
+	allRaw := exports["allRawImpl"].(func(Any, Any) Any)
+	getRaw := exports["getRawImpl"].(func(Any, Any) Any)
+	close := exports["close"].(func(Any) Any)
+
+	db := open(":memory:").(func() Any)()
+	defer close(db).(func() Any)()
+	statement := func(name string) Any {
+		query, ok := queries[name]
+		if !ok {
+			t.Fatalf("No %s query in the golden file", name)
+		}
+		return prepare(query, db).(func() Any)()
+	}
+
+	run([]Any{}, statement("createTable")).(func() Any)()
+
+	// insertTodo, with argsFor ordering the parameters as the query uses them
+	insert := statement("insertTodo")
+	info := run([]Any{"Write docs", "for the typed API", false}, insert).(func() Any)().(Dict)
+	if info["changes"] != 1 || info["lastInsertRowid"] != 1 {
+		t.Errorf("Expected 1 change and row ID 1, got %v", info)
+	}
+	run([]Any{"Ship it", "", true}, insert).(func() Any)()
+
+	// getAllTodos, parsing with SQL.fourResults @Int @String @String @Boolean
+	type todo struct {
+		id          Any
+		title       Any
+		description Any
+		completed   Any
+	}
+	parseRow := func(row_ Any) todo {
+		row := row_.([]Any)
+		if len(row) != 4 {
+			t.Fatalf("Expected exactly four results, got %d", len(row))
+		}
+		return todo{readResult(t, "Int", row[0]), readResult(t, "String", row[1]), readResult(t, "String", row[2]), readResult(t, "Boolean", row[3])}
+	}
+	selectAll := statement("getAllTodos")
+	result := allRaw([]Any{}, selectAll).(func() Any)().(Dict)
+	var todos []todo
+	for _, row := range result["rows"].([]Any) {
+		todos = append(todos, parseRow(row))
+	}
+	expected := []todo{{1, "Write docs", "for the typed API", false}, {2, "Ship it", "", true}}
+	if len(todos) != 2 || todos[0] != expected[0] || todos[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, todos)
+	}
+
+	// getCompletedTodos
+	completed := statement("getCompletedTodos")
+	result = allRaw([]Any{true}, completed).(func() Any)().(Dict)
+	if rows := result["rows"].([]Any); len(rows) != 1 || parseRow(rows[0]) != expected[1] {
+		t.Errorf("Expected only the completed todo, got %v", rows)
+	}
+
+	// updateTodoCompleted, where completed comes before id in the query
+	update := statement("updateTodoCompleted")
+	if info := run([]Any{true, 1}, update).(func() Any)().(Dict); info["changes"] != 1 {
+		t.Errorf("Expected 1 change, got %v", info)
+	}
+	first := getRaw([]Any{true}, completed).(func() Any)().(Dict)
+	if row, ok := first["value0"]; !ok || parseRow(row).completed != true {
+		t.Errorf("Expected Just the updated todo, got %v", first)
+	}
+	if rows := allRaw([]Any{false}, completed).(func() Any)().(Dict)["rows"].([]Any); len(rows) != 0 {
+		t.Errorf("Expected no incomplete todos, got %v", rows)
+	}
+}
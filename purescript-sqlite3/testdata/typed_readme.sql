@@ -0,0 +1,18 @@
+-- The SQL the purescript-sqlite3-typed README's examples prepare, as
+-- SQLTypes renders it. It is written by hand and nothing checks it against
+-- SQLTypes, so update it when the README or SQLTypes' rendering changes.
+
+-- createTable: SQL.createTable tableDefinition_todos
+CREATE TABLE todos (completed BOOLEAN NOT NULL, created_at TEXT, description TEXT, id INTEGER PRIMARY KEY NOT NULL, title TEXT NOT NULL, updated_at TEXT)
+
+-- insertTodo
+INSERT INTO todos (title, description, completed) VALUES (?,?,?)
+
+-- getAllTodos
+SELECT id, title, description, completed FROM todos
+
+-- getCompletedTodos
+SELECT id, title, description, completed FROM todos WHERE completed = ?
+
+-- updateTodoCompleted
+UPDATE todos SET completed = ? WHERE id = ?